@@ -1,9 +1,15 @@
 package bzz
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"path/filepath"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -20,8 +26,9 @@ import (
 	"github.com/ethereum/go-ethereum/swarm/pss"
 	"github.com/ethereum/go-ethereum/swarm/state"
 	"github.com/ethereum/go-ethereum/swarm/storage"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
 
-	"../service"
+	"../resource"
 )
 
 type SubService interface {
@@ -30,21 +37,80 @@ type SubService interface {
 	Protocol() *p2p.Protocol
 }
 
+// SubServiceFunc creates a SubService, so it can be registered over rpc
+type SubServiceFunc func() (SubService, error)
+
 type pssDemoService struct {
 	SubService
-	protocol *pss.Protocol
+	transport  transport
+	deregister func()
+	peers      map[string]bool // hex public keys of the peers added to the protocol
+	rpc        *rpc.Server     // serves the apis of the SubService to pss_call
+	client     *rpc.Client
+}
+
+// newPssDemoService wraps the SubService, with an in process rpc server for its apis
+func newPssDemoService(psssvc SubService, t transport) (*pssDemoService, error) {
+	server := rpc.NewServer()
+	for _, api := range psssvc.APIs() {
+		if err := server.RegisterName(api.Namespace, api.Service); err != nil {
+			server.Stop()
+			return nil, fmt.Errorf("api %s: %v", api.Namespace, err)
+		}
+	}
+	return &pssDemoService{
+		SubService: psssvc,
+		transport:  t,
+		peers:      make(map[string]bool),
+		rpc:        server,
+		client:     rpc.DialInProc(server),
+	}, nil
+}
+
+func (self *pssDemoService) close() {
+	self.client.Close()
+	self.rpc.Stop()
+}
+
+// ProtocolTopic is the pss topic a protocol is registered on, derived from its name and version
+func ProtocolTopic(spec *protocols.Spec) pss.Topic {
+	return pss.BytesToTopic([]byte(fmt.Sprintf("%s:%d", spec.Name, spec.Version)))
+}
+
+// PssPeer is a pss peer that is added to a registered protocol when the service starts
+type PssPeer struct {
+	Topic   pss.Topic
+	PubKey  hexutil.Bytes
+	Address pss.PssAddress
+	Enode   string // optional, see BzzServiceAPI.AddPeer
 }
 
 type BzzService struct {
 	bzz        *network.Bzz
+	kad        *network.Kademlia
 	lstore     *storage.LocalStore
+	netStore   *storage.NetStore // the local store, fetching missing chunks from peers
+	feeds      *feed.Handler
+	feedSigner feed.Signer
+	feedMu     sync.Mutex // feed lookups and updates share the cache of the handler
+	fileStore  *storage.FileStore
+	feedSinks  []*resource.BatchSink // closed when the service stops, after the protocols
 	ps         *pss.Pss
+	handshake  *pss.HandshakeAPI // negotiates the keys of symmetric transports
 	pssService map[pss.Topic]*pssDemoService
+	funcs      map[string]SubServiceFunc
+	bootPeers  []*PssPeer
 	//pssProtocol *pss.Protocol
 	//Topic       *pss.Topic
-	streamer *stream.Registry
-	demo     *service.Demo
-	//rh       *storage.ResourceHandler
+	streamer   *stream.Registry
+	stateStore state.Store
+	srv        *p2p.Server // set while the service is running
+	mu         sync.RWMutex
+	privateKey *ecdsa.PrivateKey
+	discovery  *discovery
+	mailbox    *mailbox
+	underlay   *enode.Node // the configured underlay address, nil if it is taken from the p2p server
+	quitC      chan struct{}
 }
 
 type NoopBalance bool
@@ -53,22 +119,44 @@ func (n *NoopBalance) Add(amount int64, p *protocols.Peer) error {
 	return nil
 }
 
-func NewBzzService(cfg *swarmapi.Config) (*BzzService, error) {
+// NewBzzService creates the service from the bzz configuration, and the underlay address the node is reachable on
+//
+// The underlay must have the public key of the bzz configuration. If it is nil, or has no ip, the address of the p2p server is used once the service starts
+func NewBzzService(cfg *swarmapi.Config, underlay *enode.Node) (*BzzService, error) {
 	var err error
 
 	// master parameters
-	self := &BzzService{}
+	self := &BzzService{
+		quitC: make(chan struct{}),
+	}
 	privkey := cfg.ShiftPrivateKey()
+	self.privateKey = privkey
+	if underlay != nil {
+		if underlay.ID() != enode.PubkeyToIDV4(&privkey.PublicKey) {
+			return nil, fmt.Errorf("underlay %s does not match the bzz key", underlay)
+		}
+		if underlay.IP() != nil && !underlay.IP().IsUnspecified() {
+			self.underlay = underlay
+		}
+	}
 	kp := network.NewKadParams()
 	to := network.NewKademlia(
 		common.FromHex(cfg.BzzKey),
 		kp,
 	)
 
+	self.kad = to
+
+	// without a configured underlay the endpoint is not known until the p2p server is running
+	// it is then updated from the server when the service starts
 	nodeID := enode.HexID(cfg.NodeID)
+	uaddr := self.underlay
+	if uaddr == nil {
+		uaddr = enode.NewV4(&privkey.PublicKey, nil, 0, 0)
+	}
 	addr := &network.BzzAddr{
 		OAddr: common.FromHex(cfg.BzzKey),
-		UAddr: []byte(enode.NewV4(&privkey.PublicKey, net.IP{127, 0, 0, 1}, 30303, 30303).String()),
+		UAddr: []byte(uaddr.String()),
 	}
 
 	// storage
@@ -79,44 +167,51 @@ func NewBzzService(cfg *swarmapi.Config) (*BzzService, error) {
 		return nil, fmt.Errorf("lstore fail: %v", err)
 	}
 
-	// resource handler
-	// TODO: BROKEN upgrade code to feeds
-	//
-	//	rhparams := &storage.ResourceHandlerParams{
-	//		QueryMaxPeriods: &storage.ResourceLookupParams{
-	//			Limit: false,
-	//		},
-	//		Signer: &storage.GenericResourceSigner{
-	//			PrivKey: privkey,
-	//		},
-	//		EthClient: storage.NewBlockEstimator(),
-	//	}
-	//	self.rh, err = storage.NewResourceHandler(rhparams)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("resource fail: %v", err)
-	//	}
-	//	self.lstore.Validators = []storage.ChunkValidator{self.rh}
+	// feeds, hosted in the local chunk store
+	self.feeds = feed.NewHandler(&feed.HandlerParams{})
+	self.feedSigner = feed.NewGenericSigner(privkey)
+	self.lstore.Validators = []storage.ChunkValidator{
+		storage.NewContentAddressValidator(storage.MakeHashFunc(storage.DefaultHash)),
+		self.feeds,
+	}
 
 	// sync/stream
-	stateStore, err := state.NewDBStore(filepath.Join(cfg.Path, "state-store.db"))
+	self.stateStore, err = state.NewDBStore(filepath.Join(cfg.Path, "state-store.db"))
 	if err != nil {
 		return nil, fmt.Errorf("statestore fail: %v", err)
 	}
 	delivery := stream.NewDelivery(to, self.lstore)
+	self.netStore, err = storage.NewNetStore(self.lstore, nil)
+	if err != nil {
+		return nil, fmt.Errorf("netstore fail: %v", err)
+	}
+	self.netStore.NewNetFetcherFunc = network.NewFetcherFactory(delivery.RequestFromPeers, true).New
+	self.feeds.SetStore(self.netStore)
+	self.fileStore = storage.NewFileStore(self.netStore, storage.NewFileStoreParams())
 
 	var noopBalance NoopBalance
-	self.streamer = stream.NewRegistry(nodeID, delivery, self.lstore, stateStore, &stream.RegistryOptions{
+	self.streamer = stream.NewRegistry(nodeID, delivery, self.lstore, self.stateStore, &stream.RegistryOptions{
 		Syncing:   stream.SyncingDisabled,
 		Retrieval: stream.RetrievalClientOnly,
 	}, &noopBalance)
 
 	// pss
 	pssparams := pss.NewPssParams().WithPrivateKey(privkey)
+	pssparams.AllowRaw = true // needed for discovery announcements
 	self.ps, err = pss.NewPss(to, pssparams)
 	if err != nil {
 		return nil, err
 	}
+	if err := pss.SetHandshakeController(self.ps, pss.NewHandshakeParams()); err != nil {
+		return nil, err
+	}
+	for _, api := range self.ps.APIs() {
+		if hs, ok := api.Service.(*pss.HandshakeAPI); ok {
+			self.handshake = hs
+		}
+	}
 	self.pssService = make(map[pss.Topic]*pssDemoService)
+	self.funcs = make(map[string]SubServiceFunc)
 
 	// bzz protocol
 	bzzconfig := &network.BzzConfig{
@@ -124,32 +219,198 @@ func NewBzzService(cfg *swarmapi.Config) (*BzzService, error) {
 		UnderlayAddr: addr.UAddr,
 		HiveParams:   cfg.HiveParams,
 	}
-	// TODO need proper loop that shuts down on network down, now the network will hang on close
-	self.bzz = network.NewBzz(bzzconfig, to, stateStore, self.streamer.GetSpec(), func(*network.BzzPeer) error {
-		for {
+	self.bzz = network.NewBzz(bzzconfig, to, self.stateStore, self.streamer.GetSpec(), self.runStreamer)
+
+	return self, nil
+}
 
+// NewUnderlay creates the underlay address of a node from the public key, and the host and port it is reachable on
+//
+// The host is an ip or a name to resolve. If it is empty, it returns nil so the address of the p2p server is used
+func NewUnderlay(pub *ecdsa.PublicKey, host string, port int) (*enode.Node, error) {
+	if host == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ipaddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("underlay host %s: %v", host, err)
 		}
-	})
-	//self.bzz = network.NewBzz(bzzconfig, to, stateStore, stream.Spec, self.streamer.Run)
+		ip = ipaddr.IP
+	}
+	return enode.NewV4(pub, ip, port, port), nil
+}
 
-	return self, nil
+// runStreamer runs the stream protocol on a connected bzz peer
+//
+// It returns when the peer disconnects or the service stops, whichever comes first
+func (self *BzzService) runStreamer(p *network.BzzPeer) error {
+	errC := make(chan error, 1)
+	go func() {
+		errC <- self.streamer.Run(p)
+	}()
+	select {
+	case err := <-errC:
+		return err
+	case <-self.quitC:
+		p.Drop(errors.New("bzz service stopped"))
+		return nil
+	}
 }
 
-func (self *BzzService) RegisterPssProtocol(psssvc SubService) error {
+// RegisterPssProtocol runs the protocol of the SubService over pss, on the topic given by ProtocolTopic
+//
+// Several versions of the same protocol can be registered side by side. If the service is already running, the SubService is started right away.
+// Its APIs can always be called through pss_call. They are also served in their own namespaces if it is registered before the node starts, since the node collects the APIs of its services only once.
+// The transport params select how the messages are sent, if nil they are encrypted with the public key of the peer
+func (self *BzzService) RegisterPssProtocol(psssvc SubService, tp *TransportParams) error {
+	if tp == nil {
+		tp = NewTransportParams(TransportAsym)
+	}
 	spec := psssvc.Spec()
-	topic := pss.BytesToTopic([]byte(fmt.Sprintf("%s:%d", spec.Name, spec.Version)))
-	psp, err := pss.RegisterProtocol(self.ps, &topic, spec, psssvc.Protocol(), &pss.ProtocolParams{true, true})
+	topic := ProtocolTopic(spec)
+
+	self.mu.Lock()
+	if _, ok := self.pssService[topic]; ok {
+		self.mu.Unlock()
+		return fmt.Errorf("pss protocol %s:%d already registered", spec.Name, spec.Version)
+	}
+	proto := psssvc.Protocol()
+	if self.mailbox != nil {
+		proto = self.mailbox.wrap(topic, proto)
+	}
+	t, err := self.newTransport(psssvc.Spec(), proto, topic, tp)
 	if err != nil {
+		self.mu.Unlock()
 		return fmt.Errorf("register pss protocol fail: %v", err)
 	}
-	self.pssService[topic] = &pssDemoService{
-		SubService: psssvc,
-		protocol:   psp,
+	demo, err := newPssDemoService(psssvc, t)
+	if err != nil {
+		self.mu.Unlock()
+		t.stop()
+		return fmt.Errorf("register pss protocol fail: %v", err)
+	}
+	if self.srv != nil {
+		if err := psssvc.Start(self.srv); err != nil {
+			self.mu.Unlock()
+			demo.close()
+			t.stop()
+			return fmt.Errorf("start pss protocol fail: %v", err)
+		}
+	}
+	hndlr := pss.NewHandler(t.handle)
+	if tp.Transport == TransportRaw {
+		hndlr = hndlr.WithRaw()
+	}
+	demo.deregister = self.ps.Register(&topic, hndlr)
+	self.pssService[topic] = demo
+	running := self.srv != nil
+	self.mu.Unlock()
+
+	if running && self.discovery != nil {
+		self.discovery.announceNow()
 	}
-	self.ps.Register(&topic, pss.NewHandler(psp.Handle))
 	return nil
 }
 
+// UnregisterPssProtocol removes the pss protocol of the topic, and all the peers it runs on
+//
+// The SubService is stopped if the service is running
+func (self *BzzService) UnregisterPssProtocol(topic pss.Topic) error {
+	self.mu.Lock()
+	psssvc, ok := self.pssService[topic]
+	if !ok {
+		self.mu.Unlock()
+		return fmt.Errorf("pss protocol not registered")
+	}
+	delete(self.pssService, topic)
+	running := self.srv != nil
+	var pubKeys []string
+	for pubKey := range psssvc.peers {
+		pubKeys = append(pubKeys, pubKey)
+	}
+	self.mu.Unlock()
+
+	psssvc.deregister()
+	for _, pubKey := range pubKeys {
+		psssvc.transport.removePeer(common.FromHex(pubKey))
+	}
+	psssvc.transport.stop()
+	psssvc.close()
+	if self.discovery != nil {
+		self.discovery.forget(topic)
+	}
+	if running {
+		return psssvc.Stop()
+	}
+	return nil
+}
+
+func (self *BzzService) newTransport(spec *protocols.Spec, proto *p2p.Protocol, topic pss.Topic, tp *TransportParams) (transport, error) {
+	switch tp.Transport {
+	case TransportAsym:
+		psp, err := pss.RegisterProtocol(self.ps, &topic, spec, proto, &pss.ProtocolParams{Asymmetric: true})
+		if err != nil {
+			return nil, err
+		}
+		return &asymTransport{
+			protocol: psp,
+			topic:    topic,
+		}, nil
+	case TransportSym:
+		if self.handshake == nil {
+			return nil, fmt.Errorf("pss handshake not available")
+		}
+		psp, err := pss.RegisterProtocol(self.ps, &topic, spec, proto, &pss.ProtocolParams{Symmetric: true})
+		if err != nil {
+			return nil, err
+		}
+		return newSymTransport(psp, topic, self.handshake, tp.KeyRotation)
+	case TransportRaw:
+		admit := func(pubKey []byte, overlay []byte) bool {
+			return self.discovery != nil && self.discovery.admit(topic, pubKey, overlay)
+		}
+		return newRawTransport(self.ps, topic, proto, self.privateKey, self.kad.BaseAddr(), admit), nil
+	}
+	return nil, fmt.Errorf("unknown pss transport %v", tp.Transport)
+}
+
+// AddSubServiceFunc makes a SubService available for registration over rpc, by name
+func (self *BzzService) AddSubServiceFunc(name string, f SubServiceFunc) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.funcs[name] = f
+}
+
+func (self *BzzService) getPssService(topic pss.Topic) (*pssDemoService, bool) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	psssvc, ok := self.pssService[topic]
+	return psssvc, ok
+}
+
+// AddBootPeer adds a pss peer to be registered with its protocol when the service starts
+func (self *BzzService) AddBootPeer(peer *PssPeer) {
+	self.bootPeers = append(self.bootPeers, peer)
+}
+
+// topics returns the topics of all registered pss protocols
+func (self *BzzService) topics() []pss.Topic {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	var topics []pss.Topic
+	for topic := range self.pssService {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (self *BzzService) hasTopic(topic pss.Topic) bool {
+	_, ok := self.getPssService(topic)
+	return ok
+}
+
 func (self *BzzService) Protocols() (protos []p2p.Protocol) {
 	protos = append(protos, self.bzz.Protocols()[0])
 	protos = append(protos, self.bzz.Protocols()[1])
@@ -168,6 +429,14 @@ func (self *BzzService) APIs() []rpc.API {
 	}
 	apis = append(apis, self.bzz.APIs()...)
 	apis = append(apis, self.ps.APIs()...)
+	apis = append(apis, rpc.API{
+		Namespace: "feed",
+		Version:   "1.0",
+		Service:   newBzzFeedAPI(self),
+		Public:    true,
+	})
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	for _, a := range self.pssService {
 		apis = append(apis, a.APIs()...)
 	}
@@ -175,30 +444,132 @@ func (self *BzzService) APIs() []rpc.API {
 }
 
 func (self *BzzService) Start(srv *p2p.Server) error {
-	newaddr := self.bzz.UpdateLocalAddr([]byte(srv.Self().String()))
+	uaddr := srv.Self()
+	if self.underlay != nil {
+		uaddr = self.underlay
+	}
+	newaddr := self.bzz.UpdateLocalAddr([]byte(uaddr.String()))
 	log.Warn("Updated bzz local addr", "oaddr", fmt.Sprintf("%x", newaddr.OAddr), "uaddr", fmt.Sprintf("%s", newaddr.UAddr))
 	err := self.bzz.Start(srv)
 	if err != nil {
 		return err
 	}
-	//self.streamer.Start(srv)
+	self.streamer.Start(srv)
 	self.ps.Start(srv)
+	self.mu.Lock()
 	for _, psssvc := range self.pssService {
-		psssvc.Start(srv)
+		if err := psssvc.Start(srv); err != nil {
+			self.mu.Unlock()
+			return err
+		}
+	}
+	self.srv = srv
+	self.mu.Unlock()
+	if self.discovery != nil {
+		self.discovery.start()
+	}
+	if self.mailbox != nil {
+		go self.mailbox.run()
+	}
+	api := newBzzServiceAPI(self)
+	for _, peer := range self.bootPeers {
+		var enodeURL *string
+		if peer.Enode != "" {
+			enodeURL = &peer.Enode
+		}
+		if err := api.AddPeer(peer.Topic, peer.PubKey, peer.Address, enodeURL); err != nil {
+			log.Error("add boot peer fail", "topic", peer.Topic, "pubkey", peer.PubKey, "err", err)
+		}
 	}
 	return nil
 }
 
+// Stop stops the pss protocols and the swarm services
+//
+// The protocols are stopped without the lock held, as they may drain for a while, and the api must stay responsive meanwhile
 func (self *BzzService) Stop() error {
+	self.mu.Lock()
+	services := make([]*pssDemoService, 0, len(self.pssService))
 	for _, psssvc := range self.pssService {
+		services = append(services, psssvc)
+	}
+	self.srv = nil
+	self.mu.Unlock()
+	for _, psssvc := range services {
 		psssvc.Stop()
 	}
+	for _, sink := range self.feedSinks {
+		if err := sink.Close(); err != nil {
+			log.Error("feed sink close fail", "err", err)
+		}
+	}
 	self.ps.Stop()
-	//self.streamer.Stop()
-	self.lstore.Close()
+	close(self.quitC)
+	self.streamer.Stop()
+	self.bzz.Stop()
+	self.netStore.Close()
+	self.stateStore.Close()
 	return nil
 }
 
+// underlay resolves the underlay address of a peer
+//
+// If the enode url is empty, the overlay address is looked up in kademlia.
+// A pss peer does not need to be directly connected, so if the address is not known the node is returned without an endpoint
+func (self *BzzService) underlay(pub *ecdsa.PublicKey, oaddr []byte, url string) (*enode.Node, error) {
+	if url != "" {
+		nod, err := enode.ParseV4(url)
+		if err != nil {
+			return nil, err
+		}
+		if nod.ID() != enode.PubkeyToIDV4(pub) {
+			return nil, fmt.Errorf("enode %s does not match public key", url)
+		}
+		return nod, nil
+	}
+	var uaddr []byte
+	self.kad.EachAddr(oaddr, 255, func(a *network.BzzAddr, po int, nn bool) bool {
+		if bytes.Equal(a.Over(), oaddr) {
+			uaddr = a.Under()
+			return false
+		}
+		return true
+	})
+	if uaddr != nil {
+		nod, err := enode.ParseV4(string(uaddr))
+		if err == nil && nod.ID() == enode.PubkeyToIDV4(pub) {
+			return nod, nil
+		}
+		log.Warn("kademlia underlay address does not match public key", "oaddr", fmt.Sprintf("%x", oaddr), "uaddr", string(uaddr))
+	}
+	return enode.NewV4(pub, nil, 0, 0), nil
+}
+
+// register adds the underlay address of a peer to kademlia, if the overlay address is complete
+func (self *BzzService) register(oaddr []byte, nod *enode.Node) {
+	if len(oaddr) != len(self.kad.BaseAddr()) {
+		log.Debug("partial overlay address, underlay not added to kademlia", "oaddr", fmt.Sprintf("%x", oaddr))
+		return
+	}
+	err := self.kad.Register(&network.BzzAddr{OAddr: oaddr, UAddr: []byte(nod.String())})
+	if err != nil {
+		log.Warn("kademlia register fail", "oaddr", fmt.Sprintf("%x", oaddr), "err", err)
+	}
+}
+
+// connect dials the peer, if its endpoint is known and the service is running
+func (self *BzzService) connect(nod *enode.Node) {
+	if nod.IP() == nil || nod.TCP() == 0 {
+		return
+	}
+	self.mu.RLock()
+	srv := self.srv
+	self.mu.RUnlock()
+	if srv != nil {
+		srv.AddPeer(nod)
+	}
+}
+
 // api to interact with pss protocol
 // TODO: change protocol methods so we only have to use pss api here and remove this structure
 type BzzServiceAPI struct {
@@ -213,9 +584,13 @@ func newBzzServiceAPI(svc *BzzService) *BzzServiceAPI {
 	}
 }
 
-func (self *BzzServiceAPI) AddPeer(topic pss.Topic, pubKey hexutil.Bytes, addr pss.PssAddress) error {
+// AddPeer adds the public key of a peer to the pss address book, and starts running the protocol of the topic on it
+//
+// The enode url of the peer is optional. If it is omitted, the underlay address is looked up in kademlia from the overlay address.
+// If the underlay address is known, the node connects to the peer directly, and an enode url given is added to kademlia with the overlay address
+func (self *BzzServiceAPI) AddPeer(topic pss.Topic, pubKey hexutil.Bytes, addr pss.PssAddress, enodeURL *string) error {
 
-	psssvc, ok := self.service.pssService[topic]
+	psssvc, ok := self.service.getPssService(topic)
 	if !ok {
 		return fmt.Errorf("pss protocol not registered")
 	}
@@ -232,18 +607,134 @@ func (self *BzzServiceAPI) AddPeer(topic pss.Topic, pubKey hexutil.Bytes, addr p
 	if err != nil {
 		return err
 	}
-	nid := enode.NewV4(pub, net.IP{127, 0, 0, 1}, 30303, 30303)
-	p2pp := p2p.NewPeer(nid.ID(), string(pubKey), []p2p.Cap{})
+	var url string
+	if enodeURL != nil {
+		url = *enodeURL
+	}
+	nod, err := self.service.underlay(pub, addr, url)
+	if err != nil {
+		return err
+	}
+	if url != "" {
+		self.service.register(addr, nod)
+	}
+	self.service.connect(nod)
+	p2pp := p2p.NewPeer(nod.ID(), string(pubKey), []p2p.Cap{})
 	log.Info(fmt.Sprintf("adding peer %s to demoservice protocol %d, %p %s", pubKey, topic, p2pp, common.ToHex(pubKey)))
-	psssvc.protocol.AddPeer(p2pp, topic, true, common.ToHex(pubKey))
+	// the mailbox must know the peer before the protocol runs on it, so it is undone if the transport fails
+	if self.service.mailbox != nil {
+		self.service.mailbox.addPeer(topic, nod.ID(), pubKey)
+	}
+	if err := psssvc.transport.addPeer(p2pp, pubKey, addr); err != nil {
+		if self.service.mailbox != nil {
+			self.service.mailbox.removePeer(topic, nod.ID())
+		}
+		return err
+	}
+	self.service.mu.Lock()
+	psssvc.peers[common.ToHex(pubKey)] = true
+	self.service.mu.Unlock()
+	if self.service.discovery != nil {
+		self.service.discovery.include(topic, pubKey)
+	}
 	return nil
 }
 
 func (self *BzzServiceAPI) RemovePeer(topic pss.Topic, pubKey hexutil.Bytes) error {
-	psssvc, ok := self.service.pssService[topic]
+	psssvc, ok := self.service.getPssService(topic)
 	if !ok {
 		return fmt.Errorf("pss protocol not registered")
 	}
-	psssvc.protocol.RemovePeer(true, common.ToHex(pubKey))
+	psssvc.transport.removePeer(pubKey)
+	self.service.mu.Lock()
+	delete(psssvc.peers, common.ToHex(pubKey))
+	self.service.mu.Unlock()
+	if self.service.discovery != nil {
+		self.service.discovery.exclude(topic, pubKey)
+	}
 	return nil
 }
+
+// ProtocolInfo describes a registered pss protocol
+type ProtocolInfo struct {
+	Topic   pss.Topic `json:"topic"`
+	Name    string    `json:"name"`
+	Version uint      `json:"version"`
+	Peers   int       `json:"peers"`
+}
+
+// Protocols lists the registered pss protocols
+func (self *BzzServiceAPI) Protocols() []*ProtocolInfo {
+	self.service.mu.RLock()
+	defer self.service.mu.RUnlock()
+	infos := make([]*ProtocolInfo, 0, len(self.service.pssService))
+	for topic, psssvc := range self.service.pssService {
+		spec := psssvc.Spec()
+		infos = append(infos, &ProtocolInfo{
+			Topic:   topic,
+			Name:    spec.Name,
+			Version: spec.Version,
+			Peers:   len(psssvc.peers),
+		})
+	}
+	return infos
+}
+
+// RegisterProtocol creates the SubService added with AddSubServiceFunc under the name, and registers its pss protocol
+//
+// The transport is optional, one of "asym" (the default), "sym" or "raw". It returns the topic the protocol is registered on
+func (self *BzzServiceAPI) RegisterProtocol(name string, transport *string) (pss.Topic, error) {
+	self.service.mu.RLock()
+	f, ok := self.service.funcs[name]
+	self.service.mu.RUnlock()
+	if !ok {
+		return pss.Topic{}, fmt.Errorf("unknown pss protocol %s", name)
+	}
+	var tp *TransportParams
+	if transport != nil {
+		t, err := ParseTransport(*transport)
+		if err != nil {
+			return pss.Topic{}, err
+		}
+		tp = NewTransportParams(t)
+	}
+	psssvc, err := f()
+	if err != nil {
+		return pss.Topic{}, err
+	}
+	if err := self.service.RegisterPssProtocol(psssvc, tp); err != nil {
+		return pss.Topic{}, err
+	}
+	return ProtocolTopic(psssvc.Spec()), nil
+}
+
+// Call calls a method of the apis of the pss protocol on the topic, like "demo_submit", and returns its json result
+//
+// It reaches the protocols registered while the node runs, whose apis the node does not serve. Subscriptions are not supported
+func (self *BzzServiceAPI) Call(ctx context.Context, topic pss.Topic, method string, args []json.RawMessage) (json.RawMessage, error) {
+	psssvc, ok := self.service.getPssService(topic)
+	if !ok {
+		return nil, fmt.Errorf("pss protocol not registered")
+	}
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		params[i] = arg
+	}
+	var result json.RawMessage
+	if err := psssvc.client.CallContext(ctx, &result, method, params...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (self *BzzServiceAPI) UnregisterProtocol(topic pss.Topic) error {
+	return self.service.UnregisterPssProtocol(topic)
+}
+
+// Mailbox returns the number of messages waiting for offline peers
+func (self *BzzServiceAPI) Mailbox() (int, error) {
+	if self.service.mailbox == nil {
+		return 0, fmt.Errorf("mailbox not enabled")
+	}
+	return self.service.mailbox.count(), nil
+}
@@ -0,0 +1,631 @@
+package bzz
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+	"github.com/ethereum/go-ethereum/swarm/state"
+)
+
+func init() {
+	log.Root().SetHandler(log.LvlFilterHandler(log.LvlTrace, log.StderrHandler))
+}
+
+var (
+	testTopic  = pss.BytesToTopic([]byte("demo:1"))
+	otherTopic = pss.BytesToTopic([]byte("other:1"))
+)
+
+func TestDiscoveryAdmit(t *testing.T) {
+	pubKey := crypto.FromECDSAPub(&newTestKey(t).PublicKey)
+
+	// none of the cases gets as far as adding the peer to the protocol, which needs a running node
+	tests := []struct {
+		name   string
+		policy DiscoveryPolicy
+		topic  pss.Topic
+		setup  func(d *discovery)
+		admit  bool
+	}{
+		{
+			name:   "not served",
+			policy: AllowAll,
+			topic:  otherTopic,
+		},
+		{
+			name:   "not allowed",
+			policy: NewAllowList(),
+			topic:  testTopic,
+		},
+		{
+			name:   "allowed",
+			policy: NewAllowList(pubKey),
+			topic:  testTopic,
+			setup: func(d *discovery) {
+				d.markAdded(testTopic, pubKey)
+			},
+			admit: true,
+		},
+		{
+			name:   "removed",
+			policy: AllowAll,
+			topic:  testTopic,
+			setup: func(d *discovery) {
+				d.markAdded(testTopic, pubKey)
+				d.exclude(testTopic, pubKey)
+			},
+		},
+		{
+			name:   "removed on other topic",
+			policy: AllowAll,
+			topic:  testTopic,
+			setup: func(d *discovery) {
+				d.markAdded(testTopic, pubKey)
+				d.exclude(otherTopic, pubKey)
+			},
+			admit: true,
+		},
+		{
+			name:   "added again",
+			policy: AllowAll,
+			topic:  testTopic,
+			setup: func(d *discovery) {
+				d.exclude(testTopic, pubKey)
+				d.include(testTopic, pubKey)
+				d.markAdded(testTopic, pubKey)
+			},
+			admit: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDiscovery(t, test.policy, testTopic)
+			if test.setup != nil {
+				test.setup(d)
+			}
+			if admit := d.admit(test.topic, pubKey, nil); admit != test.admit {
+				t.Fatalf("expected admit %v, got %v", test.admit, admit)
+			}
+		})
+	}
+}
+
+func TestDiscoveryAnnouncement(t *testing.T) {
+	key := newTestKey(t)
+	otherKey := newTestKey(t)
+
+	// the node serves no topic, so valid announcements are only checked
+	d := newTestDiscovery(t, AllowAll)
+	tests := []struct {
+		name     string
+		announce func(a *announcement) // changes the announcement after it is signed
+		key      *ecdsa.PrivateKey
+		err      bool
+	}{
+		{
+			name: "signed",
+			key:  key,
+		},
+		{
+			name: "tampered",
+			key:  key,
+			announce: func(a *announcement) {
+				a.Topics = append(a.Topics, otherTopic)
+			},
+			err: true,
+		},
+		{
+			name: "other signer",
+			key:  otherKey,
+			err:  true,
+		},
+		{
+			name: "unsigned",
+			key:  key,
+			announce: func(a *announcement) {
+				a.Signature = nil
+			},
+			err: true,
+		},
+		{
+			// our own announcements come back to us, and are ignored
+			name: "own",
+			key:  otherKey,
+			announce: func(a *announcement) {
+				a.PubKey = d.pubKey
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &announcement{
+				PubKey:  crypto.FromECDSAPub(&key.PublicKey),
+				Overlay: []byte{0x2a},
+				Topics:  []pss.Topic{testTopic},
+			}
+			if err := a.sign(test.key); err != nil {
+				t.Fatal(err)
+			}
+			if test.announce != nil {
+				test.announce(a)
+			}
+			msg, err := rlp.EncodeToBytes(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.handle(msg, nil, false, "")
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	if err := d.handle([]byte("foo"), nil, false, ""); err == nil {
+		t.Fatal("expected invalid announcement to fail")
+	}
+}
+
+func TestRawEnvelope(t *testing.T) {
+	key := newTestKey(t)
+	pubKey := crypto.FromECDSAPub(&key.PublicKey)
+	recipient := newTestKey(t)
+	to := crypto.FromECDSAPub(&recipient.PublicKey)
+
+	tests := []struct {
+		name      string
+		sender    *ecdsa.PrivateKey
+		envelopes func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope
+		errs      []bool // whether the recipient rejects each envelope
+		delivered []uint64
+	}{
+		{
+			name:   "sealed",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				return []*rawEnvelope{seal(1), seal(2)}
+			},
+			errs:      []bool{false, false},
+			delivered: []uint64{1, 2},
+		},
+		{
+			name:   "replayed",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				e := seal(1)
+				return []*rawEnvelope{e, e}
+			},
+			errs:      []bool{false, true},
+			delivered: []uint64{1},
+		},
+		{
+			name:   "other recipient",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				e := seal(1)
+				e.To = pubKey
+				resign(t, e, key)
+				return []*rawEnvelope{e}
+			},
+			errs: []bool{true},
+		},
+		{
+			name:   "tampered",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				e := seal(1)
+				e.Payload = []byte("bar")
+				return []*rawEnvelope{e}
+			},
+			errs: []bool{true},
+		},
+		{
+			name:   "stale",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				e := seal(1)
+				e.Seq -= uint64(defaultRawWindow * 2)
+				resign(t, e, key)
+				return []*rawEnvelope{e}
+			},
+			errs: []bool{true},
+		},
+		{
+			name:   "ahead",
+			sender: key,
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				e := seal(1)
+				e.Seq += uint64(defaultRawWindow * 2)
+				resign(t, e, key)
+				return []*rawEnvelope{e}
+			},
+			errs: []bool{true},
+		},
+		{
+			// messages of senders that are not peers are dropped without an error
+			name:   "unknown sender",
+			sender: newTestKey(t),
+			envelopes: func(t *testing.T, seal func(code uint64) *rawEnvelope) []*rawEnvelope {
+				return []*rawEnvelope{seal(1)}
+			},
+			errs: []bool{false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := newRawTransport(nil, testTopic, nil, test.sender, []byte{0x2a}, nil)
+			seal := func(code uint64) *rawEnvelope {
+				e := &rawEnvelope{
+					Code:    code,
+					Payload: []byte("foo"),
+				}
+				if err := sender.seal(e, to); err != nil {
+					t.Fatal(err)
+				}
+				return e
+			}
+
+			receiver := newRawTransport(nil, testTopic, nil, recipient, nil, nil)
+			rw := &rawReadWriter{
+				transport: receiver,
+				pubKey:    pubKey,
+				msgC:      make(chan p2p.Msg, defaultRawQueueSize),
+				closeC:    make(chan struct{}),
+			}
+			receiver.peers[common.ToHex(pubKey)] = rw
+
+			for i, e := range test.envelopes(t, seal) {
+				msg, err := rlp.EncodeToBytes(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = receiver.handle(msg, nil, false, "")
+				if (err != nil) != test.errs[i] {
+					t.Fatalf("envelope %d: expected error %v, got %v", i, test.errs[i], err)
+				}
+			}
+			if len(rw.msgC) != len(test.delivered) {
+				t.Fatalf("expected %d messages delivered, got %d", len(test.delivered), len(rw.msgC))
+			}
+			for _, code := range test.delivered {
+				msg := <-rw.msgC
+				payload, err := ioutil.ReadAll(msg.Payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.Code != code || !bytes.Equal(payload, []byte("foo")) {
+					t.Fatalf("expected message %d with payload foo, got %d with %q", code, msg.Code, payload)
+				}
+			}
+		})
+	}
+}
+
+// resign signs an envelope again after it was changed, with the key it was sealed with
+func resign(t *testing.T, e *rawEnvelope, key *ecdsa.PrivateKey) {
+	digest, err := e.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Signature, err = crypto.Sign(digest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sequence numbers increase even if the clock doesn't
+func TestNextSeq(t *testing.T) {
+	now := time.Now()
+	seq := nextSeq(0, now)
+	if seq != uint64(now.UnixNano()) {
+		t.Fatalf("expected sequence number %d, got %d", now.UnixNano(), seq)
+	}
+	if next := nextSeq(seq, now); next != seq+1 {
+		t.Fatalf("expected sequence number %d, got %d", seq+1, next)
+	}
+	if next := nextSeq(seq, now.Add(-time.Second)); next != seq+1 {
+		t.Fatalf("expected sequence number %d after the clock went back, got %d", seq+1, next)
+	}
+}
+
+func TestSymKeyRotation(t *testing.T) {
+	hs := newTestHandshake()
+	proto := newTestProtocol()
+	tr, err := newSymTransport(proto, testTopic, hs, time.Millisecond*50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.stop()
+
+	pubKey := crypto.FromECDSAPub(&newTestKey(t).PublicKey)
+	p := p2p.NewPeer(enode.ID{}, "test", nil)
+	if err := tr.addPeer(p, pubKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first session", func() bool {
+		return proto.sessions() != ""
+	})
+
+	// the session of the first key is replaced by one with a new key, and the first key is released
+	waitFor(t, "key rotation", func() bool {
+		tr.mu.Lock()
+		session := tr.sessions[common.ToHex(pubKey)]
+		tr.mu.Unlock()
+		return session != nil && session.key != "key1" && proto.sessions() == session.key && hs.isReleased("key1")
+	})
+
+	tr.removePeer(pubKey)
+	if sessions := proto.sessions(); sessions != "" {
+		t.Fatalf("expected no sessions after the peer is removed, got %s", sessions)
+	}
+	if err := tr.handle(nil, p, true, ""); err == nil {
+		t.Fatal("expected asymmetric message on symmetric protocol to fail")
+	}
+}
+
+// testHandshake hands out a new key for a peer on every flush, and records the keys released
+type testHandshake struct {
+	n        int
+	keys     map[string]string // the current key by public key
+	released map[string]bool
+	mu       sync.Mutex
+}
+
+func newTestHandshake() *testHandshake {
+	return &testHandshake{
+		keys:     make(map[string]string),
+		released: make(map[string]bool),
+	}
+}
+
+func (self *testHandshake) AddHandshake(topic pss.Topic) error {
+	return nil
+}
+
+func (self *testHandshake) RemoveHandshake(topic *pss.Topic) error {
+	return nil
+}
+
+func (self *testHandshake) Handshake(pubkeyid string, topic pss.Topic, sync bool, flush bool) ([]string, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if key, ok := self.keys[pubkeyid]; ok && !flush {
+		return []string{key}, nil
+	}
+	self.n++
+	key := fmt.Sprintf("key%d", self.n)
+	self.keys[pubkeyid] = key
+	return []string{key}, nil
+}
+
+func (self *testHandshake) ReleaseHandshakeKey(pubkeyid string, topic pss.Topic, key string, flush bool) (bool, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.released[key] = true
+	return true, nil
+}
+
+func (self *testHandshake) isReleased(key string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.released[key]
+}
+
+// testProtocol records the keys of the protocol sessions
+type testProtocol struct {
+	keys map[string]bool
+	mu   sync.Mutex
+}
+
+func newTestProtocol() *testProtocol {
+	return &testProtocol{
+		keys: make(map[string]bool),
+	}
+}
+
+func (self *testProtocol) AddPeer(p *p2p.Peer, topic pss.Topic, asymmetric bool, key string) (p2p.MsgReadWriter, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.keys[key] = true
+	return nil, nil
+}
+
+func (self *testProtocol) RemovePeer(asymmetric bool, key string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.keys, key)
+}
+
+func (self *testProtocol) Handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error {
+	return nil
+}
+
+// sessions returns the keys of the sessions, comma separated
+func (self *testProtocol) sessions() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var keys []string
+	for k := range self.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// messages for an offline peer are kept until they expire, and flushed in order when the peer is back
+func TestMailbox(t *testing.T) {
+	key := newTestKey(t)
+	peerKey := newTestKey(t)
+	id := enode.ID{0x2a}
+	k := mailboxKey(testTopic, id)
+
+	tests := []struct {
+		name string
+		ttls []time.Duration // of the messages stored, the code of each message is its index
+		kept []uint64        // the codes of the messages left after the expired ones are pruned
+	}{
+		{
+			name: "fresh",
+			ttls: []time.Duration{time.Hour, time.Hour},
+			kept: []uint64{0, 1},
+		},
+		{
+			name: "expired",
+			ttls: []time.Duration{-time.Second},
+		},
+		{
+			name: "mixed",
+			ttls: []time.Duration{-time.Second, time.Hour, -time.Second, time.Hour},
+			kept: []uint64{1, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := state.NewInmemoryStore()
+			mb := newTestMailbox(t, key, store)
+			mb.addPeer(testTopic, id, crypto.FromECDSAPub(&peerKey.PublicKey))
+
+			// the peer has no session, so everything goes to the mailbox
+			for i, ttl := range test.ttls {
+				mb.params.TTL = ttl
+				if err := mb.send(k, nil, p2p.Msg{Code: uint64(i), Payload: bytes.NewReader([]byte("foo"))}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := newTestMailbox(t, key, store).count(); n != len(test.ttls) {
+				t.Fatalf("expected %d messages in the stored mailbox, got %d", len(test.ttls), n)
+			}
+
+			mb.mu.Lock()
+			mb.prune(k)
+			mb.mu.Unlock()
+			if n := mb.count(); n != len(test.kept) {
+				t.Fatalf("expected %d messages after prune, got %d", len(test.kept), n)
+			}
+
+			// the peer comes back online
+			rw, peerRW := p2p.MsgPipe()
+			defer rw.Close()
+			mb.mu.Lock()
+			mb.sessions[k] = &mailboxSession{
+				rw:   rw,
+				base: 10,
+				seen: time.Now(),
+			}
+			mb.mu.Unlock()
+			errC := make(chan error, 1)
+			go func() {
+				errC <- mb.flush(k)
+			}()
+			peer := &mailbox{key: peerKey}
+			for _, code := range test.kept {
+				msg, err := peerRW.ReadMsg()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.Code != 10+mailboxEnvelope {
+					t.Fatalf("expected stored message, got code %d", msg.Code)
+				}
+				data, err := ioutil.ReadAll(msg.Payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stored, err := peer.open(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload, err := ioutil.ReadAll(stored.Payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Code != code || !bytes.Equal(payload, []byte("foo")) {
+					t.Fatalf("expected message %d with payload foo, got %d with %q", code, stored.Code, payload)
+				}
+			}
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+			if n := mb.count(); n != 0 {
+				t.Fatalf("expected empty mailbox after flush, got %d messages", n)
+			}
+			if n := newTestMailbox(t, key, store).count(); n != 0 {
+				t.Fatalf("expected empty stored mailbox after flush, got %d messages", n)
+			}
+
+			// with nothing waiting, messages to the online peer are sent directly
+			go func() {
+				errC <- mb.send(k, rw, p2p.Msg{Code: 1, Payload: bytes.NewReader([]byte("foo"))})
+			}()
+			msg, err := peerRW.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Discard()
+			if msg.Code != 1 {
+				t.Fatalf("expected message 1 sent directly, got code %d", msg.Code)
+			}
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// newTestMailbox returns the mailbox of a service that isn't running, loaded from the store
+func newTestMailbox(t *testing.T, key *ecdsa.PrivateKey, store state.Store) *mailbox {
+	s := &BzzService{
+		stateStore: store,
+		privateKey: key,
+		quitC:      make(chan struct{}),
+	}
+	if err := s.EnableMailbox(nil); err != nil {
+		t.Fatal(err)
+	}
+	return s.mailbox
+}
+
+// newTestDiscovery returns the discovery of a service that serves the topics, but isn't running
+func newTestDiscovery(t *testing.T, policy DiscoveryPolicy, topics ...pss.Topic) *discovery {
+	s := &BzzService{
+		pssService: make(map[pss.Topic]*pssDemoService),
+		privateKey: newTestKey(t),
+		quitC:      make(chan struct{}),
+	}
+	for _, topic := range topics {
+		s.pssService[topic] = &pssDemoService{}
+	}
+	s.EnableDiscovery(policy, 0)
+	return s.discovery
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	timeout := time.After(time.Second)
+	for !f() {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", what)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package bzz
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+const (
+	discoveryTopicName            = "demo-discovery:1"
+	defaultDiscoveryAnnounceDelay = time.Second * 30
+)
+
+var (
+	// all nodes announce the pss protocols they serve on this topic
+	DiscoveryTopic = pss.BytesToTopic([]byte(discoveryTopicName))
+)
+
+// DiscoveryPolicy decides which announced peers are added to the registered pss protocols
+type DiscoveryPolicy interface {
+	Allow(pubKey []byte, topic pss.Topic) bool
+}
+
+type allowAll struct{}
+
+func (allowAll) Allow(pubKey []byte, topic pss.Topic) bool {
+	return true
+}
+
+// AllowAll adds every peer that announces a topic we serve
+var AllowAll DiscoveryPolicy = allowAll{}
+
+// AllowList only adds peers with the listed public keys
+type AllowList struct {
+	keys map[string]bool
+}
+
+func NewAllowList(pubKeys ...[]byte) *AllowList {
+	l := &AllowList{
+		keys: make(map[string]bool),
+	}
+	for _, k := range pubKeys {
+		l.keys[common.ToHex(k)] = true
+	}
+	return l
+}
+
+func (self *AllowList) Allow(pubKey []byte, topic pss.Topic) bool {
+	return self.keys[common.ToHex(pubKey)]
+}
+
+// announcement is broadcast on the discovery topic
+//
+// The signature is over the keccak256 hash of the rlp encoded fields, and must match the public key
+type announcement struct {
+	PubKey    []byte
+	Overlay   []byte
+	Topics    []pss.Topic
+	Signature []byte
+}
+
+func (a *announcement) digest() ([]byte, error) {
+	data, err := rlp.EncodeToBytes([]interface{}{a.PubKey, a.Overlay, a.Topics})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+func (a *announcement) sign(key *ecdsa.PrivateKey) error {
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	a.Signature, err = crypto.Sign(digest, key)
+	return err
+}
+
+// discovery announces the pss protocols served by the node, and adds the peers that announce the same protocols
+type discovery struct {
+	service  *BzzService
+	policy   DiscoveryPolicy
+	delay    time.Duration
+	pubKey   []byte
+	added    map[pss.Topic]map[string]bool // peers already added, by topic and hex public key
+	removed  map[pss.Topic]map[string]bool // peers removed by hand, not added again until they are added explicitly
+	mu       sync.Mutex
+	quitC    chan struct{}
+	announce chan struct{}
+}
+
+// EnableDiscovery makes the service find pss peers for its registered protocols automatically
+//
+// Peers are only added if the policy allows it. Must be called before the service is started
+func (self *BzzService) EnableDiscovery(policy DiscoveryPolicy, delay time.Duration) {
+	if delay == 0 {
+		delay = defaultDiscoveryAnnounceDelay
+	}
+	self.discovery = &discovery{
+		service:  self,
+		policy:   policy,
+		delay:    delay,
+		pubKey:   crypto.FromECDSAPub(&self.privateKey.PublicKey),
+		added:    make(map[pss.Topic]map[string]bool),
+		removed:  make(map[pss.Topic]map[string]bool),
+		quitC:    self.quitC,
+		announce: make(chan struct{}, 1),
+	}
+}
+
+func (self *discovery) start() {
+	self.service.ps.Register(&DiscoveryTopic, pss.NewHandler(self.handle).WithRaw())
+	go self.run()
+}
+
+// announceNow sends an announcement right away, instead of waiting for the next scheduled one
+func (self *discovery) announceNow() {
+	select {
+	case self.announce <- struct{}{}:
+	default:
+	}
+}
+
+func (self *discovery) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-self.quitC:
+			return
+		case <-self.announce:
+		case <-timer.C:
+			timer.Reset(self.delay)
+		}
+		if err := self.send(); err != nil {
+			log.Warn("pss discovery announce fail", "err", err)
+		}
+	}
+}
+
+func (self *discovery) send() error {
+	a := &announcement{
+		PubKey:  self.pubKey,
+		Overlay: self.service.kad.BaseAddr(),
+		Topics:  self.service.topics(),
+	}
+	if err := a.sign(self.service.privateKey); err != nil {
+		return err
+	}
+	data, err := rlp.EncodeToBytes(a)
+	if err != nil {
+		return err
+	}
+
+	// an empty address reaches every node
+	return self.service.ps.SendRaw(pss.PssAddress{}, DiscoveryTopic, data)
+}
+
+func (self *discovery) handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error {
+	var a announcement
+	if err := rlp.DecodeBytes(msg, &a); err != nil {
+		return fmt.Errorf("invalid discovery announcement: %v", err)
+	}
+	if bytes.Equal(a.PubKey, self.pubKey) {
+		return nil
+	}
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	signer, err := crypto.SigToPub(digest, a.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid discovery announcement signature: %v", err)
+	} else if !bytes.Equal(crypto.FromECDSAPub(signer), a.PubKey) {
+		return fmt.Errorf("discovery announcement signature does not match public key")
+	}
+
+	for _, topic := range a.Topics {
+		self.admit(topic, a.PubKey, a.Overlay)
+	}
+	return nil
+}
+
+// admit adds a peer to the protocol of the topic if the policy allows it, and it was not removed by hand
+//
+// It returns whether the peer was added, now or before
+func (self *discovery) admit(topic pss.Topic, pubKey []byte, overlay []byte) bool {
+	if !self.service.hasTopic(topic) || !self.policy.Allow(pubKey, topic) || self.isRemoved(topic, pubKey) {
+		return false
+	}
+	if !self.markAdded(topic, pubKey) {
+		return true
+	}
+	log.Debug("pss discovery found peer", "topic", topic, "pubkey", common.ToHex(pubKey), "oaddr", fmt.Sprintf("%x", overlay))
+	if err := newBzzServiceAPI(self.service).AddPeer(topic, pubKey, overlay, nil); err != nil {
+		log.Warn("pss discovery add peer fail", "topic", topic, "err", err)
+		self.unmarkAdded(topic, pubKey)
+		return false
+	}
+	return true
+}
+
+// markAdded records that a peer was added to the protocol of a topic
+//
+// It returns false if it already was
+func (self *discovery) markAdded(topic pss.Topic, pubKey []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	key := common.ToHex(pubKey)
+	if self.added[topic] == nil {
+		self.added[topic] = make(map[string]bool)
+	} else if self.added[topic][key] {
+		return false
+	}
+	self.added[topic][key] = true
+	return true
+}
+
+func (self *discovery) unmarkAdded(topic pss.Topic, pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.added[topic], common.ToHex(pubKey))
+}
+
+// exclude keeps a peer removed by hand from being added again by discovery
+func (self *discovery) exclude(topic pss.Topic, pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	key := common.ToHex(pubKey)
+	delete(self.added[topic], key)
+	if self.removed[topic] == nil {
+		self.removed[topic] = make(map[string]bool)
+	}
+	self.removed[topic][key] = true
+}
+
+// include lets discovery add a peer again, once it is added explicitly
+func (self *discovery) include(topic pss.Topic, pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.removed[topic], common.ToHex(pubKey))
+}
+
+func (self *discovery) isRemoved(topic pss.Topic, pubKey []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.removed[topic][common.ToHex(pubKey)]
+}
+
+// forget drops the peers added to the protocol of a topic, when the protocol is unregistered
+func (self *discovery) forget(topic pss.Topic) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.added, topic)
+}
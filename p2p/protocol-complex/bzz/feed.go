@@ -0,0 +1,334 @@
+package bzz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+
+	"../resource"
+	"../service"
+)
+
+const (
+	defaultFeedTimeout      = time.Second * 10
+	defaultFeedChunkTimeout = time.Second * 2 // for update chunks fetched from the network, most epochs walked are empty
+
+	// layout of a feed update chunk: header | topic | user | epoch | data | signature
+	feedHeaderLength    = 8
+	feedEpochOffset     = feedHeaderLength + feed.TopicLength + common.AddressLength
+	feedDataOffset      = feedEpochOffset + lookup.EpochLength
+	feedSignatureLength = 65
+)
+
+// FeedUpdate is an update of a feed hosted by the node
+type FeedUpdate struct {
+	Time  uint64        `json:"time"` // the time the update was published
+	Level uint8         `json:"level"`
+	Data  hexutil.Bytes `json:"data"`
+}
+
+// ownFeed returns the feed of the topic name that the node publishes to
+func (self *BzzService) ownFeed(topicName string) (*feed.Feed, error) {
+	topic, err := feed.NewTopic(topicName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &feed.Feed{
+		Topic: topic,
+		User:  self.feedSigner.Address(),
+	}, nil
+}
+
+// PublishFeed publishes the data as the next update of the feed of the topic name, signed by the node key
+func (self *BzzService) PublishFeed(ctx context.Context, topicName string, data []byte) error {
+	fd, err := self.ownFeed(topicName)
+	if err != nil {
+		return err
+	}
+	return self.publishFeed(ctx, fd, data)
+}
+
+func (self *BzzService) publishFeed(ctx context.Context, fd *feed.Feed, data []byte) error {
+	self.feedMu.Lock()
+	defer self.feedMu.Unlock()
+	request, err := self.feeds.NewRequest(ctx, fd)
+	if err != nil {
+		return err
+	}
+	request.SetData(data)
+	if err := request.Sign(self.feedSigner); err != nil {
+		return err
+	}
+	_, err = self.feeds.Update(ctx, request)
+	return err
+}
+
+// FeedBatchSink returns a sink that publishes results in batches to the feed of the topic name, see resource.BatchSink
+//
+// The batches are uploaded to the local chunk store. The sink is closed when the service stops
+func (self *BzzService) FeedBatchSink(topicName string, size int, delay time.Duration) (*resource.BatchSink, error) {
+	fd, err := self.ownFeed(topicName)
+	if err != nil {
+		return nil, err
+	}
+	sink := resource.NewBatchSink(&localFeed{service: self, feed: fd}, size, delay)
+	self.feedSinks = append(self.feedSinks, sink)
+	return sink, nil
+}
+
+// lookupFeed returns the last update of the feed at or before the time, or the latest update if the time is 0
+//
+// It returns nil if there is no such update
+func (self *BzzService) lookupFeed(ctx context.Context, fd *feed.Feed, t uint64) (*FeedUpdate, error) {
+	var query *feed.Query
+	if t == 0 {
+		query = feed.NewQueryLatest(fd, lookup.NoClue)
+	} else {
+		query = feed.NewQuery(fd, t, lookup.NoClue)
+	}
+	self.feedMu.Lock()
+	defer self.feedMu.Unlock()
+	entry, err := self.feeds.Lookup(ctx, query)
+	if ferr, ok := err.(*feed.Error); ok && ferr.Code() == feed.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	_, data, err := self.feeds.GetContent(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &FeedUpdate{
+		Time:  entry.Epoch.Time,
+		Level: entry.Epoch.Level,
+		Data:  data,
+	}, nil
+}
+
+// feedHistory returns all updates of the feed, oldest first
+//
+// The epochs are walked down from the top level epoch of the latest update, so every update is found, also of several published in the same second.
+// Earlier top level epochs are walked until one is empty. As the child epochs are looked up at once, and each lookup of a chunk from the network has its own timeout, the walk takes at most a chunk timeout per level of each top level epoch, however many updates there are
+func (self *BzzService) feedHistory(ctx context.Context, fd *feed.Feed) ([]*FeedUpdate, error) {
+	latest, err := self.lookupFeed(ctx, fd, 0)
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	var updates []*FeedUpdate
+	var mu sync.Mutex
+	get := func(ctx context.Context, epoch lookup.Epoch) (bool, error) {
+		u, err := self.feedUpdate(ctx, fd, epoch)
+		if err != nil || u == nil {
+			return false, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, u)
+		return true, nil
+	}
+	span := uint64(1) << lookup.HighestLevel
+	for t := latest.Time &^ (span - 1); ; t -= span {
+		found, err := resource.WalkEpoch(ctx, lookup.Epoch{Time: t, Level: lookup.HighestLevel}, latest.Time, get)
+		if err != nil {
+			return nil, err
+		}
+		if !found || t < span {
+			break
+		}
+	}
+
+	// a later update is in a later epoch, or in a lower level of the same one
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Time != updates[j].Time {
+			return updates[i].Time < updates[j].Time
+		}
+		return updates[i].Level > updates[j].Level
+	})
+	return updates, nil
+}
+
+// feedUpdate returns the update of the feed in the epoch, or nil if there is none
+//
+// Updates of feeds of other nodes are fetched from the network if they are not in the local store.
+// The signature is not checked again, as the feed validator of the store checks it when the chunk is stored
+func (self *BzzService) feedUpdate(ctx context.Context, fd *feed.Feed, epoch lookup.Epoch) (*FeedUpdate, error) {
+	id := feed.ID{
+		Feed:  *fd,
+		Epoch: epoch,
+	}
+	data, err := self.feedChunk(ctx, id.Addr(), fd.User != self.feedSigner.Address())
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if len(data) < feedDataOffset+feedSignatureLength {
+		return nil, fmt.Errorf("feed update %x too short, %d bytes", id.Addr(), len(data))
+	}
+	var stored lookup.Epoch
+	if err := stored.UnmarshalBinary(data[feedEpochOffset:feedDataOffset]); err != nil {
+		return nil, fmt.Errorf("feed update %x invalid: %v", id.Addr(), err)
+	}
+	return &FeedUpdate{
+		Time:  stored.Time,
+		Level: stored.Level,
+		Data:  data[feedDataOffset : len(data)-feedSignatureLength],
+	}, nil
+}
+
+// feedChunk returns the data of the update chunk at the address, or nil if there is none
+//
+// If remote is set, a chunk that is not in the local store is fetched from the network, waiting at most the chunk timeout
+func (self *BzzService) feedChunk(ctx context.Context, addr storage.Address, remote bool) ([]byte, error) {
+	chunk, err := self.lstore.Get(ctx, addr)
+	if err == storage.ErrChunkNotFound && remote {
+		fctx, cancel := context.WithTimeout(ctx, defaultFeedChunkTimeout)
+		chunk, err = self.netStore.Get(fctx, addr)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			return nil, nil
+		}
+	}
+	if err == storage.ErrChunkNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return chunk.Data(), nil
+}
+
+// BzzFeedAPI looks up updates of the feeds in the local chunk store
+type BzzFeedAPI struct {
+	service *BzzService
+}
+
+func newBzzFeedAPI(svc *BzzService) *BzzFeedAPI {
+	return &BzzFeedAPI{
+		service: svc,
+	}
+}
+
+// feed returns the feed of the topic name and user, which defaults to the node itself
+func (self *BzzFeedAPI) feed(topicName string, user *common.Address) (*feed.Feed, error) {
+	fd, err := self.service.ownFeed(topicName)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		fd.User = *user
+	}
+	return fd, nil
+}
+
+// Latest returns the latest update of a feed
+func (self *BzzFeedAPI) Latest(ctx context.Context, topicName string, user *common.Address) (*FeedUpdate, error) {
+	return self.At(ctx, topicName, 0, user)
+}
+
+// At returns the last update of a feed published at or before the unix time
+func (self *BzzFeedAPI) At(ctx context.Context, topicName string, t uint64, user *common.Address) (*FeedUpdate, error) {
+	fd, err := self.feed(topicName, user)
+	if err != nil {
+		return nil, err
+	}
+	u, err := self.service.lookupFeed(ctx, fd, t)
+	if err != nil {
+		return nil, err
+	} else if u == nil {
+		return nil, fmt.Errorf("no feed update found")
+	}
+	return u, nil
+}
+
+// History returns all updates of a feed, oldest first
+func (self *BzzFeedAPI) History(ctx context.Context, topicName string, user *common.Address) ([]*FeedUpdate, error) {
+	fd, err := self.feed(topicName, user)
+	if err != nil {
+		return nil, err
+	}
+	return self.service.feedHistory(ctx, fd)
+}
+
+// Chunk returns the raw update chunk at the address, from the local store or the network, or nothing if there is none
+//
+// The chunk holds the signature of the update, so a client can verify the update without trusting the node
+func (self *BzzFeedAPI) Chunk(ctx context.Context, addr hexutil.Bytes) (hexutil.Bytes, error) {
+	return self.service.feedChunk(ctx, storage.Address(addr), true)
+}
+
+// Results returns the verified results published in batches to a feed, oldest first
+func (self *BzzFeedAPI) Results(ctx context.Context, topicName string, user *common.Address) ([]*service.ResultRecord, error) {
+	fd, err := self.feed(topicName, user)
+	if err != nil {
+		return nil, err
+	}
+	return resource.RetrieveResults(ctx, &localFeed{service: self.service, feed: fd})
+}
+
+// Publish publishes the data as the next update of the feed of the topic name, owned by the node
+func (self *BzzFeedAPI) Publish(ctx context.Context, topicName string, data hexutil.Bytes) error {
+	return self.service.PublishFeed(ctx, topicName, data)
+}
+
+// localFeed is a feed in the local chunk store, with the content its updates point to
+//
+// It is a resource.Publisher if the feed is owned by the node, and always a resource.Source
+type localFeed struct {
+	service *BzzService
+	feed    *feed.Feed
+}
+
+func (self *localFeed) Upload(ctx context.Context, data []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultFeedTimeout)
+	defer cancel()
+	addr, wait, err := self.service.fileStore.Store(ctx, bytes.NewReader(data), int64(len(data)), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := wait(ctx); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (self *localFeed) Update(ctx context.Context, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultFeedTimeout)
+	defer cancel()
+	return self.service.publishFeed(ctx, self.feed, data)
+}
+
+// History walks the whole feed, which is not bounded by the feed timeout, see feedHistory
+func (self *localFeed) History(ctx context.Context) ([][]byte, error) {
+	updates, err := self.service.feedHistory(ctx, self.feed)
+	if err != nil {
+		return nil, err
+	}
+	history := make([][]byte, len(updates))
+	for i, u := range updates {
+		history[i] = u.Data
+	}
+	return history, nil
+}
+
+func (self *localFeed) Download(ctx context.Context, addr []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultFeedTimeout)
+	defer cancel()
+	reader, _ := self.service.fileStore.Retrieve(ctx, storage.Address(addr))
+	size, err := reader.Size(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := reader.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
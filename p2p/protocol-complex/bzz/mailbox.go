@@ -0,0 +1,483 @@
+package bzz
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+	"github.com/ethereum/go-ethereum/swarm/state"
+)
+
+const (
+	defaultMailboxTTL        = time.Hour * 24
+	defaultMailboxCheckDelay = time.Second
+	defaultMailboxTimeout    = time.Second * 5
+	mailboxIndexKey          = "mailbox"
+	mailboxKeyPrefix         = "mailbox/"
+)
+
+// message codes the mailbox uses on top of those of the protocol, counted from the protocol length
+const (
+	mailboxPing     = iota // asks the peer for a pong, to tell if it is online
+	mailboxPong            // the reply to a ping
+	mailboxEnvelope        // a stored message, encrypted with the public key of the peer
+)
+
+// MailboxParams configures the mailbox of a BzzService
+type MailboxParams struct {
+	TTL        time.Duration // how long messages are kept for an offline peer
+	CheckDelay time.Duration // how often the mailbox pings its peers, and delivers to those that are back online
+	Timeout    time.Duration // a peer counts as offline when nothing was heard from it for this long
+}
+
+func NewMailboxParams() *MailboxParams {
+	return &MailboxParams{
+		TTL:        defaultMailboxTTL,
+		CheckDelay: defaultMailboxCheckDelay,
+		Timeout:    defaultMailboxTimeout,
+	}
+}
+
+// mailboxEntry is a protocol message waiting for its peer to come online
+type mailboxEntry struct {
+	Data    []byte // the rlp encoded code and payload, encrypted with the public key of the peer
+	Expires time.Time
+}
+
+// mailboxPeer holds the messages waiting for one peer of one protocol
+type mailboxPeer struct {
+	PubKey  []byte
+	Entries []*mailboxEntry
+}
+
+// mailboxSession is a protocol session running on a peer, and when the peer was last heard from
+type mailboxSession struct {
+	rw   p2p.MsgReadWriter
+	base uint64 // the first message code of the mailbox, after those of the protocol
+	seen time.Time
+}
+
+// mailbox keeps protocol messages sent to offline pss peers, and delivers them when the peers are back
+//
+// Only peers added with BzzServiceAPI.AddPeer have a mailbox. A peer counts as online while its protocol session answers pings.
+// The messages are kept in the state store, encrypted with the public key of the peer, so they survive a restart of the node,
+// and are sent as they are once the peer is back. Both sides must have the mailbox enabled
+type mailbox struct {
+	store    state.Store
+	key      *ecdsa.PrivateKey
+	params   *MailboxParams
+	boxes    map[string]*mailboxPeer    // by mailbox key
+	sessions map[string]*mailboxSession // running protocol sessions, by mailbox key
+	peers    map[string][]byte          // public keys of the added peers, by mailbox key
+	flushing map[string]bool            // mailboxes being delivered, by mailbox key
+	mu       sync.Mutex
+	quitC    chan struct{}
+}
+
+// mailboxKey identifies a peer of a protocol
+func mailboxKey(topic pss.Topic, id enode.ID) string {
+	return fmt.Sprintf("%x/%s", topic[:], id)
+}
+
+// EnableMailbox keeps messages to offline pss peers until they come back online, for up to the TTL in the params
+//
+// Must be called before any pss protocol is registered
+func (self *BzzService) EnableMailbox(params *MailboxParams) error {
+	if params == nil {
+		params = NewMailboxParams()
+	}
+	mb := &mailbox{
+		store:    self.stateStore,
+		key:      self.privateKey,
+		params:   params,
+		boxes:    make(map[string]*mailboxPeer),
+		sessions: make(map[string]*mailboxSession),
+		peers:    make(map[string][]byte),
+		flushing: make(map[string]bool),
+		quitC:    self.quitC,
+	}
+	if err := mb.load(); err != nil {
+		return fmt.Errorf("mailbox load fail: %v", err)
+	}
+	self.mailbox = mb
+	return nil
+}
+
+func (self *mailbox) load() error {
+	var keys []string
+	err := self.store.Get(mailboxIndexKey, &keys)
+	if err == state.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		box := &mailboxPeer{}
+		if err := self.store.Get(mailboxKeyPrefix+k, box); err != nil {
+			log.Warn("mailbox entry load fail", "key", k, "err", err)
+			continue
+		}
+		self.boxes[k] = box
+		self.peers[k] = box.PubKey
+	}
+	return nil
+}
+
+// save writes a mailbox to the state store, and deletes it if it's empty
+//
+// Must be called with the lock held
+func (self *mailbox) save(k string) {
+	var err error
+	if box, ok := self.boxes[k]; ok && len(box.Entries) > 0 {
+		err = self.store.Put(mailboxKeyPrefix+k, box)
+	} else {
+		delete(self.boxes, k)
+		err = self.store.Delete(mailboxKeyPrefix + k)
+	}
+	if err != nil {
+		log.Warn("mailbox save fail", "key", k, "err", err)
+	}
+	keys := make([]string, 0, len(self.boxes))
+	for k := range self.boxes {
+		keys = append(keys, k)
+	}
+	if err := self.store.Put(mailboxIndexKey, keys); err != nil {
+		log.Warn("mailbox index save fail", "err", err)
+	}
+}
+
+// addPeer records the public key of a peer added to a protocol, which gives it a mailbox
+func (self *mailbox) addPeer(topic pss.Topic, id enode.ID, pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.peers[mailboxKey(topic, id)] = pubKey
+}
+
+// removePeer stops keeping messages for the peer on the topic
+//
+// Messages already in its mailbox are kept until they expire
+func (self *mailbox) removePeer(topic pss.Topic, id enode.ID) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.peers, mailboxKey(topic, id))
+}
+
+// wrap returns a copy of the protocol that writes through the mailbox
+func (self *mailbox) wrap(topic pss.Topic, proto *p2p.Protocol) *p2p.Protocol {
+	run := proto.Run
+	base := uint64(proto.Length)
+	wrapped := *proto
+	wrapped.Run = func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+		k := mailboxKey(topic, p.ID())
+		session := &mailboxSession{
+			rw:   rw,
+			base: base,
+		}
+		self.mu.Lock()
+		self.sessions[k] = session
+		_, added := self.peers[k]
+		self.mu.Unlock()
+		defer func() {
+			self.mu.Lock()
+			if self.sessions[k] == session {
+				delete(self.sessions, k)
+			}
+			self.mu.Unlock()
+		}()
+		if added {
+			go self.ping(k, session)
+		}
+		return run(p, &mailboxReadWriter{
+			MsgReadWriter: rw,
+			mailbox:       self,
+			session:       session,
+			key:           k,
+		})
+	}
+	return &wrapped
+}
+
+// online tells if the protocol session on the peer has been heard from recently
+//
+// Must be called with the lock held
+func (self *mailbox) online(k string) bool {
+	session, ok := self.sessions[k]
+	return ok && time.Since(session.seen) < self.params.Timeout
+}
+
+func (self *mailbox) ping(k string, session *mailboxSession) {
+	if err := session.rw.WriteMsg(p2p.Msg{Code: session.base + mailboxPing, Payload: bytes.NewReader(nil)}); err != nil {
+		log.Debug("mailbox ping fail", "key", k, "err", err)
+	}
+}
+
+// send writes the message to the peer if it is online and has no messages waiting
+//
+// Otherwise the message is encrypted for the peer and added to its mailbox, which is delivered right away if the peer is online
+func (self *mailbox) send(k string, rw p2p.MsgReadWriter, msg p2p.Msg) error {
+	self.mu.Lock()
+	pubKey, ok := self.peers[k]
+	box := self.boxes[k]
+	online := self.online(k)
+	direct := !ok || (online && (box == nil || len(box.Entries) == 0) && !self.flushing[k])
+	self.mu.Unlock()
+	if direct {
+		return rw.WriteMsg(msg)
+	}
+
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	data, err := rlp.EncodeToBytes([]interface{}{msg.Code, payload})
+	if err != nil {
+		return err
+	}
+	pub, err := crypto.UnmarshalPubkey(pubKey)
+	if err != nil {
+		return err
+	}
+	data, err = ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pub), data, nil, nil)
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	box, ok = self.boxes[k]
+	if !ok {
+		box = &mailboxPeer{
+			PubKey: pubKey,
+		}
+		self.boxes[k] = box
+	}
+	box.Entries = append(box.Entries, &mailboxEntry{
+		Data:    data,
+		Expires: time.Now().Add(self.params.TTL),
+	})
+	self.save(k)
+	waiting := len(box.Entries)
+	self.mu.Unlock()
+	log.Debug("mailbox stored message", "key", k, "code", msg.Code, "waiting", waiting)
+
+	if online {
+		return self.flush(k)
+	}
+	return nil
+}
+
+// flush sends the unexpired messages waiting in the mailbox of a peer, on its current protocol session
+//
+// Messages that could not be sent stay in the mailbox. Only one flush of a mailbox runs at a time, others return right away
+func (self *mailbox) flush(k string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.flushing[k] {
+		return nil
+	}
+	self.flushing[k] = true
+	defer delete(self.flushing, k)
+
+	for {
+		box, ok := self.boxes[k]
+		session, running := self.sessions[k]
+		if !ok || !running || len(box.Entries) == 0 {
+			return nil
+		}
+		entries := box.Entries
+		box.Entries = nil
+		self.save(k)
+
+		self.mu.Unlock()
+		n, err := self.write(session, entries)
+		self.mu.Lock()
+
+		if err != nil {
+			box, ok := self.boxes[k]
+			if !ok {
+				box = &mailboxPeer{
+					PubKey: self.peers[k],
+				}
+				self.boxes[k] = box
+			}
+			box.Entries = append(entries[n:], box.Entries...)
+			self.save(k)
+			return err
+		}
+		log.Debug("mailbox flushed", "key", k, "count", n)
+	}
+}
+
+// write sends the unexpired entries as they are, and returns how many entries are done
+func (self *mailbox) write(session *mailboxSession, entries []*mailboxEntry) (int, error) {
+	now := time.Now()
+	for i, e := range entries {
+		if !e.Expires.After(now) {
+			continue
+		}
+		if err := session.rw.WriteMsg(p2p.Msg{
+			Code:    session.base + mailboxEnvelope,
+			Size:    uint32(len(e.Data)),
+			Payload: bytes.NewReader(e.Data),
+		}); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// open decrypts a stored message sent by a peer
+func (self *mailbox) open(data []byte) (p2p.Msg, error) {
+	data, err := ecies.ImportECDSA(self.key).Decrypt(data, nil, nil)
+	if err != nil {
+		return p2p.Msg{}, err
+	}
+	var m struct {
+		Code    uint64
+		Payload []byte
+	}
+	if err := rlp.DecodeBytes(data, &m); err != nil {
+		return p2p.Msg{}, err
+	}
+	return p2p.Msg{
+		Code:       m.Code,
+		Size:       uint32(len(m.Payload)),
+		Payload:    bytes.NewReader(m.Payload),
+		ReceivedAt: time.Now(),
+	}, nil
+}
+
+// prune removes the expired messages of a mailbox
+//
+// Must be called with the lock held
+func (self *mailbox) prune(k string) {
+	box := self.boxes[k]
+	now := time.Now()
+	entries := box.Entries[:0]
+	for _, e := range box.Entries {
+		if e.Expires.After(now) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != len(box.Entries) {
+		log.Debug("mailbox expired messages", "key", k, "count", len(box.Entries)-len(entries))
+		box.Entries = entries
+		self.save(k)
+	}
+}
+
+// run pings the peers with a mailbox, delivers the waiting messages of peers that are back online, and drops expired messages
+func (self *mailbox) run() {
+	ticker := time.NewTicker(self.params.CheckDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.quitC:
+			return
+		case <-ticker.C:
+		}
+		pings := make(map[string]*mailboxSession)
+		var ready []string
+		self.mu.Lock()
+		for k, session := range self.sessions {
+			if _, ok := self.peers[k]; ok {
+				pings[k] = session
+			}
+		}
+		for k := range self.boxes {
+			if self.online(k) {
+				ready = append(ready, k)
+			} else if !self.flushing[k] {
+				self.prune(k)
+			}
+		}
+		self.mu.Unlock()
+
+		for k, session := range pings {
+			self.ping(k, session)
+		}
+		for _, k := range ready {
+			if err := self.flush(k); err != nil {
+				log.Warn("mailbox flush fail", "key", k, "err", err)
+			}
+		}
+	}
+}
+
+// count returns the number of messages waiting in the mailbox
+func (self *mailbox) count() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var n int
+	for _, box := range self.boxes {
+		n += len(box.Entries)
+	}
+	return n
+}
+
+// seen marks the peer of the session as online
+func (self *mailbox) seen(session *mailboxSession) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	session.seen = time.Now()
+}
+
+// mailboxReadWriter is the MsgReadWriter of a protocol session through the mailbox
+//
+// It answers the pings of the peer and opens its stored messages, and passes everything else on to the protocol
+type mailboxReadWriter struct {
+	p2p.MsgReadWriter
+	mailbox *mailbox
+	session *mailboxSession
+	key     string
+}
+
+func (self *mailboxReadWriter) ReadMsg() (p2p.Msg, error) {
+	for {
+		msg, err := self.MsgReadWriter.ReadMsg()
+		if err != nil {
+			return msg, err
+		}
+		self.mailbox.seen(self.session)
+		switch msg.Code {
+		case self.session.base + mailboxPing:
+			msg.Discard()
+			if err := self.MsgReadWriter.WriteMsg(p2p.Msg{Code: self.session.base + mailboxPong, Payload: bytes.NewReader(nil)}); err != nil {
+				log.Debug("mailbox pong fail", "key", self.key, "err", err)
+			}
+		case self.session.base + mailboxPong:
+			msg.Discard()
+			go func() {
+				if err := self.mailbox.flush(self.key); err != nil {
+					log.Warn("mailbox flush fail", "key", self.key, "err", err)
+				}
+			}()
+		case self.session.base + mailboxEnvelope:
+			data, err := ioutil.ReadAll(msg.Payload)
+			if err != nil {
+				return p2p.Msg{}, err
+			}
+			stored, err := self.mailbox.open(data)
+			if err != nil {
+				log.Warn("mailbox message open fail, dropping it", "key", self.key, "err", err)
+				continue
+			}
+			return stored, nil
+		default:
+			return msg, nil
+		}
+	}
+}
+
+func (self *mailboxReadWriter) WriteMsg(msg p2p.Msg) error {
+	return self.mailbox.send(self.key, self.MsgReadWriter, msg)
+}
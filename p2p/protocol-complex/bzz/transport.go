@@ -0,0 +1,519 @@
+package bzz
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// Transport selects how the messages of a pss protocol are sent
+type Transport int
+
+const (
+	TransportAsym Transport = iota // encrypted with the public key of the peer
+	TransportSym                   // encrypted with symmetric keys negotiated with the pss handshake
+	TransportRaw                   // not encrypted, only signed
+)
+
+const (
+	defaultKeyRotation  = time.Hour
+	defaultRawQueueSize = 64          // messages waiting for the protocol of a raw peer, more are dropped
+	defaultRawWindow    = time.Minute // raw envelopes older than this, or as much ahead of the local clock, are rejected
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportAsym:
+		return "asym"
+	case TransportSym:
+		return "sym"
+	case TransportRaw:
+		return "raw"
+	}
+	return fmt.Sprintf("transport(%d)", int(t))
+}
+
+// ParseTransport returns the transport of the name given by Transport.String
+func ParseTransport(s string) (Transport, error) {
+	for _, t := range []Transport{TransportAsym, TransportSym, TransportRaw} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pss transport %s", s)
+}
+
+// TransportParams configures the transport of a pss protocol
+type TransportParams struct {
+	Transport Transport
+
+	// for the symmetric transport, how often new keys are negotiated with each peer
+	// a new key restarts the protocol session on the peer. 0 disables rotation
+	KeyRotation time.Duration
+}
+
+func NewTransportParams(t Transport) *TransportParams {
+	return &TransportParams{
+		Transport:   t,
+		KeyRotation: defaultKeyRotation,
+	}
+}
+
+// transport runs a protocol over pss on the peers added to it
+type transport interface {
+	addPeer(p *p2p.Peer, pubKey []byte, addr pss.PssAddress) error
+	removePeer(pubKey []byte)
+	handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error
+	stop()
+}
+
+// asymTransport sends every message encrypted with the public key of the peer
+type asymTransport struct {
+	protocol *pss.Protocol
+	topic    pss.Topic
+}
+
+func (self *asymTransport) addPeer(p *p2p.Peer, pubKey []byte, addr pss.PssAddress) error {
+	_, err := self.protocol.AddPeer(p, self.topic, true, common.ToHex(pubKey))
+	return err
+}
+
+func (self *asymTransport) removePeer(pubKey []byte) {
+	self.protocol.RemovePeer(true, common.ToHex(pubKey))
+}
+
+func (self *asymTransport) handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error {
+	if !asymmetric {
+		return fmt.Errorf("symmetric message on asymmetric protocol")
+	}
+	return self.protocol.Handle(msg, p, asymmetric, keyid)
+}
+
+func (self *asymTransport) stop() {}
+
+// pssProtocol is the part of pss.Protocol the symmetric transport uses
+type pssProtocol interface {
+	AddPeer(p *p2p.Peer, topic pss.Topic, asymmetric bool, key string) (p2p.MsgReadWriter, error)
+	RemovePeer(asymmetric bool, key string)
+	Handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error
+}
+
+// pssHandshake is the part of pss.HandshakeAPI the symmetric transport uses
+type pssHandshake interface {
+	AddHandshake(topic pss.Topic) error
+	RemoveHandshake(topic *pss.Topic) error
+	Handshake(pubkeyid string, topic pss.Topic, sync bool, flush bool) ([]string, error)
+	ReleaseHandshakeKey(pubkeyid string, topic pss.Topic, key string, flush bool) (bool, error)
+}
+
+// symSession is a protocol session on a peer with the symmetric key it uses
+type symSession struct {
+	peer *p2p.Peer
+	key  string
+}
+
+// symTransport negotiates symmetric keys with each peer using the pss handshake, and rotates them periodically
+//
+// Both sides must have the public key of the other in their pss address book for the handshake to succeed
+type symTransport struct {
+	protocol pssProtocol
+	topic    pss.Topic
+	hs       pssHandshake
+	rotation time.Duration
+	sessions map[string]*symSession // by hex public key
+	mu       sync.Mutex
+	quitC    chan struct{}
+}
+
+func newSymTransport(psp pssProtocol, topic pss.Topic, hs pssHandshake, rotation time.Duration) (*symTransport, error) {
+	if err := hs.AddHandshake(topic); err != nil {
+		return nil, err
+	}
+	self := &symTransport{
+		protocol: psp,
+		topic:    topic,
+		hs:       hs,
+		rotation: rotation,
+		sessions: make(map[string]*symSession),
+		quitC:    make(chan struct{}),
+	}
+	if rotation > 0 {
+		go self.rotate()
+	}
+	return self, nil
+}
+
+// addPeer starts the handshake with the peer, and runs the protocol on it when the keys arrive
+//
+// The handshake waits for the reply of the peer, which is processed by pss handlers, so it can't block here
+func (self *symTransport) addPeer(p *p2p.Peer, pubKey []byte, addr pss.PssAddress) error {
+	go func() {
+		if err := self.newSession(p, pubKey, false); err != nil {
+			log.Warn("pss handshake fail", "topic", self.topic, "pubkey", common.ToHex(pubKey), "err", err)
+		}
+	}()
+	return nil
+}
+
+// newSession gets a key for the peer and runs the protocol on it, replacing the current session if any
+//
+// If flush is set, new keys are negotiated even if valid ones exist
+func (self *symTransport) newSession(p *p2p.Peer, pubKey []byte, flush bool) error {
+	pubKeyHex := common.ToHex(pubKey)
+	keys, err := self.hs.Handshake(pubKeyHex, self.topic, true, flush)
+	if err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return fmt.Errorf("no keys from handshake")
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if old, ok := self.sessions[pubKeyHex]; ok {
+		if old.key == keys[0] {
+			return nil
+		}
+		self.protocol.RemovePeer(false, old.key)
+		if _, err := self.hs.ReleaseHandshakeKey(pubKeyHex, self.topic, old.key, false); err != nil {
+			log.Warn("pss release key fail", "topic", self.topic, "pubkey", pubKeyHex, "err", err)
+		}
+	}
+	if _, err := self.protocol.AddPeer(p, self.topic, false, keys[0]); err != nil {
+		delete(self.sessions, pubKeyHex)
+		return err
+	}
+	self.sessions[pubKeyHex] = &symSession{
+		peer: p,
+		key:  keys[0],
+	}
+	return nil
+}
+
+func (self *symTransport) removePeer(pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pubKeyHex := common.ToHex(pubKey)
+	session, ok := self.sessions[pubKeyHex]
+	if !ok {
+		return
+	}
+	self.protocol.RemovePeer(false, session.key)
+	delete(self.sessions, pubKeyHex)
+}
+
+func (self *symTransport) handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error {
+	if asymmetric {
+		return fmt.Errorf("asymmetric message on symmetric protocol")
+	}
+	return self.protocol.Handle(msg, p, asymmetric, keyid)
+}
+
+func (self *symTransport) rotate() {
+	ticker := time.NewTicker(self.rotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.quitC:
+			return
+		case <-ticker.C:
+		}
+		self.mu.Lock()
+		sessions := make(map[string]*p2p.Peer, len(self.sessions))
+		for pubKeyHex, session := range self.sessions {
+			sessions[pubKeyHex] = session.peer
+		}
+		self.mu.Unlock()
+		for pubKeyHex, p := range sessions {
+			log.Debug("pss key rotation", "topic", self.topic, "pubkey", pubKeyHex)
+			if err := self.newSession(p, common.FromHex(pubKeyHex), true); err != nil {
+				log.Warn("pss key rotation fail", "topic", self.topic, "pubkey", pubKeyHex, "err", err)
+			}
+		}
+	}
+}
+
+func (self *symTransport) stop() {
+	close(self.quitC)
+	if err := self.hs.RemoveHandshake(&self.topic); err != nil {
+		log.Warn("pss remove handshake fail", "topic", self.topic, "err", err)
+	}
+}
+
+// rawEnvelope carries a protocol message with the raw transport
+//
+// Raw pss messages do not reveal their sender, so the envelope identifies and authenticates it.
+// The signature is over the keccak256 hash of the rlp encoded fields. It covers the recipient and a sequence number, so an envelope can't be replayed, to the same peer or another
+type rawEnvelope struct {
+	PubKey    []byte
+	Overlay   []byte
+	To        []byte // public key of the recipient
+	Seq       uint64 // the send time in unix nanoseconds, increasing with every envelope of the sender
+	Code      uint64
+	Payload   []byte
+	Signature []byte
+}
+
+func (e *rawEnvelope) digest() ([]byte, error) {
+	data, err := rlp.EncodeToBytes([]interface{}{e.PubKey, e.Overlay, e.To, e.Seq, e.Code, e.Payload})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// rawTransport sends messages unencrypted, and runs the protocol itself since pss.Protocol can't
+type rawTransport struct {
+	ps         *pss.Pss
+	topic      pss.Topic
+	protocol   *p2p.Protocol
+	privateKey *ecdsa.PrivateKey
+	overlay    []byte
+	admit      func(pubKey []byte, overlay []byte) bool // adds an unknown sender as a peer if it is allowed, may be nil
+	peers      map[string]*rawReadWriter                // by hex public key
+	windows    map[string]*rawWindow                    // the sequence numbers seen from each sender, by hex public key
+	seq        uint64                                   // the sequence number of the last envelope sent
+	mu         sync.Mutex
+}
+
+func newRawTransport(ps *pss.Pss, topic pss.Topic, protocol *p2p.Protocol, privateKey *ecdsa.PrivateKey, overlay []byte, admit func(pubKey []byte, overlay []byte) bool) *rawTransport {
+	return &rawTransport{
+		ps:         ps,
+		topic:      topic,
+		protocol:   protocol,
+		privateKey: privateKey,
+		overlay:    overlay,
+		admit:      admit,
+		peers:      make(map[string]*rawReadWriter),
+		windows:    make(map[string]*rawWindow),
+	}
+}
+
+func (self *rawTransport) addPeer(p *p2p.Peer, pubKey []byte, addr pss.PssAddress) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pubKeyHex := common.ToHex(pubKey)
+	if _, ok := self.peers[pubKeyHex]; ok {
+		return nil
+	}
+	rw := &rawReadWriter{
+		transport: self,
+		pubKey:    pubKey,
+		addr:      addr,
+		msgC:      make(chan p2p.Msg, defaultRawQueueSize),
+		closeC:    make(chan struct{}),
+	}
+	self.peers[pubKeyHex] = rw
+	go func() {
+		err := self.protocol.Run(p, rw)
+		log.Debug("pss raw protocol exit", "topic", self.topic, "pubkey", pubKeyHex, "err", err)
+		self.removePeer(pubKey)
+	}()
+	return nil
+}
+
+func (self *rawTransport) removePeer(pubKey []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pubKeyHex := common.ToHex(pubKey)
+	rw, ok := self.peers[pubKeyHex]
+	if !ok {
+		return
+	}
+	close(rw.closeC)
+	delete(self.peers, pubKeyHex)
+}
+
+// handle passes a message to the protocol running on its sender
+//
+// Messages from senders that are not peers are dropped, unless admit adds the sender as a peer.
+// Envelopes to another recipient, and replayed or stale ones, are rejected
+func (self *rawTransport) handle(msg []byte, p *p2p.Peer, asymmetric bool, keyid string) error {
+	if asymmetric || keyid != "" {
+		return fmt.Errorf("encrypted message on raw protocol")
+	}
+	var e rawEnvelope
+	if err := rlp.DecodeBytes(msg, &e); err != nil {
+		return fmt.Errorf("invalid raw envelope: %v", err)
+	}
+	if err := self.verify(&e); err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	rw, ok := self.peers[common.ToHex(e.PubKey)]
+	self.mu.Unlock()
+	if !ok {
+		if self.admit == nil || !self.admit(e.PubKey, e.Overlay) {
+			log.Trace("raw message from unknown peer dropped", "topic", self.topic, "pubkey", common.ToHex(e.PubKey))
+			return nil
+		}
+		self.mu.Lock()
+		rw = self.peers[common.ToHex(e.PubKey)]
+		self.mu.Unlock()
+		if rw == nil {
+			return fmt.Errorf("raw peer exited")
+		}
+	}
+	if !self.fresh(e.PubKey, e.Seq, time.Now()) {
+		return fmt.Errorf("raw envelope %d from %s replayed or stale", e.Seq, common.ToHex(e.PubKey))
+	}
+	return rw.deliver(p2p.Msg{
+		Code:       e.Code,
+		Size:       uint32(len(e.Payload)),
+		Payload:    bytes.NewReader(e.Payload),
+		ReceivedAt: time.Now(),
+	})
+}
+
+// seal fills in the sender, the sequence number and the signature of an envelope to the recipient
+func (self *rawTransport) seal(e *rawEnvelope, to []byte) error {
+	self.mu.Lock()
+	self.seq = nextSeq(self.seq, time.Now())
+	e.Seq = self.seq
+	self.mu.Unlock()
+	e.PubKey = crypto.FromECDSAPub(&self.privateKey.PublicKey)
+	e.Overlay = self.overlay
+	e.To = to
+	digest, err := e.digest()
+	if err != nil {
+		return err
+	}
+	e.Signature, err = crypto.Sign(digest, self.privateKey)
+	return err
+}
+
+// verify checks that the envelope is signed by the public key it carries, and is for this node
+func (self *rawTransport) verify(e *rawEnvelope) error {
+	digest, err := e.digest()
+	if err != nil {
+		return err
+	}
+	signer, err := crypto.SigToPub(digest, e.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid raw envelope signature: %v", err)
+	} else if !bytes.Equal(crypto.FromECDSAPub(signer), e.PubKey) {
+		return fmt.Errorf("raw envelope signature does not match public key")
+	} else if !bytes.Equal(e.To, crypto.FromECDSAPub(&self.privateKey.PublicKey)) {
+		return fmt.Errorf("raw envelope for another recipient")
+	}
+	return nil
+}
+
+// fresh records the sequence number of an envelope of the sender, and tells whether it was not seen before and is within the window of the time now
+func (self *rawTransport) fresh(pubKey []byte, seq uint64, now time.Time) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pubKeyHex := common.ToHex(pubKey)
+	w, ok := self.windows[pubKeyHex]
+	if !ok {
+		w = newRawWindow(defaultRawWindow)
+		self.windows[pubKeyHex] = w
+	}
+	return w.check(seq, now)
+}
+
+func (self *rawTransport) stop() {}
+
+// nextSeq returns the sequence number of the next envelope, the time now in unix nanoseconds, but always above the last one
+func nextSeq(last uint64, now time.Time) uint64 {
+	seq := uint64(now.UnixNano())
+	if seq <= last {
+		seq = last + 1
+	}
+	return seq
+}
+
+// rawWindow remembers the sequence numbers seen from a sender within a time window
+//
+// A sequence number is accepted once, and only if it is within the window of the local clock, so replays are rejected however long after they come.
+// As the sequence numbers are send times, the window also bounds how far apart the clocks of the nodes may be
+type rawWindow struct {
+	window time.Duration
+	seen   map[uint64]bool
+}
+
+func newRawWindow(window time.Duration) *rawWindow {
+	return &rawWindow{
+		window: window,
+		seen:   make(map[uint64]bool),
+	}
+}
+
+func (self *rawWindow) check(seq uint64, now time.Time) bool {
+	t := now.UnixNano()
+	if seq < uint64(t-int64(self.window)) || seq > uint64(t+int64(self.window)) {
+		return false
+	} else if self.seen[seq] {
+		return false
+	}
+	for s := range self.seen {
+		if s < uint64(t-int64(self.window)) {
+			delete(self.seen, s)
+		}
+	}
+	self.seen[seq] = true
+	return true
+}
+
+// rawReadWriter is the MsgReadWriter of a protocol running on a raw transport peer
+type rawReadWriter struct {
+	transport *rawTransport
+	pubKey    []byte
+	addr      pss.PssAddress
+	msgC      chan p2p.Msg
+	closeC    chan struct{}
+}
+
+func (self *rawReadWriter) ReadMsg() (p2p.Msg, error) {
+	select {
+	case msg := <-self.msgC:
+		return msg, nil
+	case <-self.closeC:
+		return p2p.Msg{}, io.EOF
+	}
+}
+
+func (self *rawReadWriter) WriteMsg(msg p2p.Msg) error {
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	e := &rawEnvelope{
+		Code:    msg.Code,
+		Payload: payload,
+	}
+	if err := self.transport.seal(e, self.pubKey); err != nil {
+		return err
+	}
+	data, err := rlp.EncodeToBytes(e)
+	if err != nil {
+		return err
+	}
+	return self.transport.ps.SendRaw(self.addr, self.transport.topic, data)
+}
+
+// deliver queues a message for the protocol, and drops it if the queue is full, so a slow protocol does not hold up pss
+func (self *rawReadWriter) deliver(msg p2p.Msg) error {
+	select {
+	case <-self.closeC:
+		return fmt.Errorf("raw peer exited")
+	default:
+	}
+	select {
+	case self.msgC <- msg:
+		return nil
+	default:
+		return fmt.Errorf("raw peer queue full, message dropped")
+	}
+}
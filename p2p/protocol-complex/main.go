@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -11,7 +12,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/node"
 
 	"./service"
@@ -30,6 +33,12 @@ var (
 	bzzport  = flag.String("b", "8555", "bzz port")
 	enode    = flag.String("e", "", "enode to connect to")
 	httpapi  = flag.String("a", "localhost:8545", "http api")
+	jobs     = flag.String("j", "", "submit jobs instead of hashing; file to read jobs from, '-' for stdin, 'queue' for rpc")
+	jobdiff  = flag.Int("d", 16, "difficulty of jobs read from file or stdin")
+
+	// the go-ethereum metrics package enables itself when it finds the flag on the command line
+	_           = flag.Bool(metrics.MetricsEnabledFlag, false, "enable metrics collection")
+	metricsaddr = flag.String("metricsaddr", "localhost:6060", "http endpoint for metrics, if enabled")
 )
 
 func init() {
@@ -46,6 +55,13 @@ func main() {
 	}
 	defer os.RemoveAll(datadir)
 
+	if metrics.Enabled {
+		go func() {
+			err := http.ListenAndServe(*metricsaddr, service.NewMetricsHandler(metrics.DefaultRegistry))
+			log.Error("metrics endpoint fail", "err", err)
+		}()
+	}
+
 	cfg := &node.DefaultConfig
 	cfg.P2P.ListenAddr = fmt.Sprintf(":%d", *port)
 	cfg.P2P.EnableMsgEvents = true
@@ -61,7 +77,7 @@ func main() {
 	if *httpapi != "" {
 		cfg.HTTPHost = httpspec[0]
 		cfg.HTTPPort = int(httpport)
-		cfg.HTTPModules = []string{"demo", "admin", "pss"}
+		cfg.HTTPModules = []string{"demo", "demoadmin", "admin", "pss"}
 	}
 	cfg.DataDir = datadir
 
@@ -72,16 +88,41 @@ func main() {
 	}
 
 	// create the demo service and register it with the node stack
+	var jobFile *os.File
 	if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
 		params := service.NewDemoParams(nil, nil)
+		params.Id = crypto.FromECDSAPub(&ctx.NodeKey().PublicKey)[1:]
 		params.MaxJobs = defaultMaxJobs
 		params.MaxTimePerJob = defaultMaxTime
 		params.MaxDifficulty = defaultMaxDifficulty
+		switch *jobs {
+		case "":
+		case "queue":
+			params.MaxDifficulty = 0
+			params.Source = service.NewQueueSource(0)
+		case "-":
+			params.MaxDifficulty = 0
+			params.Source = service.NewLineSource(os.Stdin, uint8(*jobdiff))
+		default:
+			f, err := os.Open(*jobs)
+			if err != nil {
+				return nil, err
+			}
+			jobFile = f
+			params.MaxDifficulty = 0
+			params.Source = service.NewLineSource(f, uint8(*jobdiff))
+		}
 		return service.NewDemo(params)
 	}); err != nil {
 		log.Error(err.Error())
 		return
 	}
+	// the job file is closed once the service has stopped reading it
+	defer func() {
+		if jobFile != nil {
+			jobFile.Close()
+		}
+	}()
 	if err := stack.Start(); err != nil {
 		log.Error(err.Error())
 		return
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/node"
 	swarmapi "github.com/ethereum/go-ethereum/swarm/api"
+	"github.com/ethereum/go-ethereum/swarm/pss"
 
 	"./bzz"
 	"./service"
@@ -22,19 +27,40 @@ import (
 
 const (
 	ipcName              = "pssdemo.ipc"
+	defaultDataDirName   = ".pssdemo"
+	keyFileName          = "bzzkey"
 	defaultMaxDifficulty = 23
 	defaultMaxJobs       = 3
 	defaultMaxTime       = time.Second
 )
 
 var (
-	loglevel = flag.Int("l", 3, "loglevel")
-	port     = flag.Int("p", 30499, "p2p port")
-	bzzport  = flag.String("b", "8555", "bzz port")
-	enode    = flag.String("e", "", "enode to connect to")
-	httpapi  = flag.String("a", "localhost:8545", "http api")
+	loglevel  = flag.Int("l", 3, "loglevel")
+	port      = flag.Int("p", 30499, "p2p port")
+	host      = flag.String("u", "", "host or ip other nodes reach the p2p port on, advertised as bzz underlay address (default: taken from the p2p server)")
+	bzzport   = flag.String("b", "8555", "bzz port")
+	enode     = flag.String("e", "", "enode to connect to")
+	httpapi   = flag.String("a", "localhost:8545", "http api")
+	datadir   = flag.String("d", "", "data directory (default $HOME/"+defaultDataDirName+")")
+	keyfile   = flag.String("k", "", "bzz private key file, created if it doesn't exist (default <datadir>/"+keyFileName+")")
+	config    = flag.String("c", "", "pss peer configuration file, json")
+	transp    = flag.String("t", "asym", "pss transport of the demo protocol: asym, sym or raw")
+	mailbox   = flag.Duration("m", 0, "keep messages to offline pss peers for this long, 0 disables the mailbox")
+	feedTopic = flag.String("f", "", "publish expired results to the feed with this topic name, in the local chunk store")
 )
 
+// pssPeerConfig is a pss peer entry in the configuration file
+type pssPeerConfig struct {
+	PublicKey string // hex encoded public key
+	Topic     string // hex encoded pss topic, or protocol name and version as "name:version"
+	Address   string // hex encoded overlay address, may be partial
+	Enode     string // optional enode url of the peer
+}
+
+type pssConfig struct {
+	Peers []pssPeerConfig
+}
+
 func init() {
 	flag.Parse()
 	log.Root().SetHandler(log.CallerFileHandler(log.LvlFilterHandler(log.Lvl(*loglevel), (log.StreamHandler(os.Stderr, log.TerminalFormat(true))))))
@@ -42,14 +68,33 @@ func init() {
 
 func main() {
 
-	datadir, err := ioutil.TempDir("", "pssmailboxdemo-")
-	if err != nil {
+	if *datadir == "" {
+		*datadir = filepath.Join(os.Getenv("HOME"), defaultDataDirName)
+	}
+	if err := os.MkdirAll(*datadir, 0700); err != nil {
 		log.Error("dir create fail", "err", err)
 		return
 	}
-	defer os.RemoveAll(datadir)
+	if *keyfile == "" {
+		*keyfile = filepath.Join(*datadir, keyFileName)
+	}
+	privkey, err := loadKey(*keyfile)
+	if err != nil {
+		log.Error("key load fail", "err", err)
+		return
+	}
+	var peers []*bzz.PssPeer
+	if *config != "" {
+		peers, err = loadPeers(*config)
+		if err != nil {
+			log.Error("config load fail", "err", err)
+			return
+		}
+	}
 
+	// the p2p server runs on the bzz key, so the advertised underlay enode is the node's own
 	cfg := &node.DefaultConfig
+	cfg.P2P.PrivateKey = privkey
 	cfg.P2P.ListenAddr = fmt.Sprintf(":%d", *port)
 	cfg.P2P.EnableMsgEvents = true
 	cfg.IPCPath = ipcName
@@ -64,9 +109,9 @@ func main() {
 	if *httpapi != "" {
 		cfg.HTTPHost = httpspec[0]
 		cfg.HTTPPort = int(httpport)
-		cfg.HTTPModules = []string{"demo", "admin", "pss"}
+		cfg.HTTPModules = []string{"demo", "admin", "pss", "feed"}
 	}
-	cfg.DataDir = datadir
+	cfg.DataDir = *datadir
 
 	stack, err := node.New(cfg)
 	if err != nil {
@@ -74,42 +119,74 @@ func main() {
 		return
 	}
 
-	// create the demo service, but now we don't register it directly
-	// so we avoid the protocol running on the direct connected peers
-	params := service.NewDemoParams(nil, nil)
-	params.MaxJobs = defaultMaxJobs
-	params.MaxTimePerJob = defaultMaxTime
-	params.MaxDifficulty = defaultMaxDifficulty
-	svc, err := service.NewDemo(params)
+	// create the pss service that wraps the demo protocol
+	bzzCfg := swarmapi.NewConfig()
+	bzzCfg.SyncEnabled = false
+	bzzCfg.Port = *bzzport
+	bzzCfg.Path = *datadir
+	bzzCfg.HiveParams.Discovery = true
+	bzzCfg.Init(privkey)
+
+	underlay, err := bzz.NewUnderlay(&privkey.PublicKey, *host, *port)
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
-
-	// create the pss service that wraps the demo protocol
-	privkey, err := crypto.GenerateKey()
+	bzzSvc, err := bzz.NewBzzService(bzzCfg, underlay)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	// create the demo service, but now we don't register it directly
+	// so we avoid the protocol running on the direct connected peers
+	// expired results are published in batches to a feed in the local chunk store, if a topic is given
+	var sinkFunc service.ResultSinkFunc
+	if *feedTopic != "" {
+		sink, err := bzzSvc.FeedBatchSink(*feedTopic, 0, 0)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		sinkFunc = sink.SinkFunc()
+	}
+	newDemo := func() (bzz.SubService, error) {
+		params := service.NewDemoParams(sinkFunc, nil)
+		params.Id = crypto.FromECDSAPub(&privkey.PublicKey)[1:]
+		params.MaxJobs = defaultMaxJobs
+		params.MaxTimePerJob = defaultMaxTime
+		params.MaxDifficulty = defaultMaxDifficulty
+		return service.NewDemo(params)
+	}
+	svc, err := newDemo()
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
 
-	bzzCfg := swarmapi.NewConfig()
-	bzzCfg.SyncEnabled = false
-	bzzCfg.Port = *bzzport
-	bzzCfg.Path = datadir
-	bzzCfg.HiveParams.Discovery = true
-	bzzCfg.Init(privkey)
-
-	bzzSvc, err := bzz.NewBzzService(bzzCfg)
+	// the demo protocol can be unregistered and registered again over rpc
+	bzzSvc.AddSubServiceFunc("demo", newDemo)
+	if *mailbox > 0 {
+		mbparams := bzz.NewMailboxParams()
+		mbparams.TTL = *mailbox
+		err = bzzSvc.EnableMailbox(mbparams)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+	t, err := bzz.ParseTransport(*transp)
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
-	err = bzzSvc.RegisterPssProtocol(svc)
+	err = bzzSvc.RegisterPssProtocol(svc, bzz.NewTransportParams(t))
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
+	for _, peer := range peers {
+		bzzSvc.AddBootPeer(peer)
+	}
 
 	if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
 		return bzzSvc, nil
@@ -127,3 +204,63 @@ func main() {
 	signal.Notify(sigC, syscall.SIGINT)
 	<-sigC
 }
+
+// loadKey loads the private key from file, or generates and saves a new one if the file doesn't exist
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	privkey, err := crypto.LoadECDSA(path)
+	if err == nil {
+		return privkey, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	privkey, err = crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("generated new key", "path", path)
+	return privkey, crypto.SaveECDSA(path, privkey)
+}
+
+// loadPeers reads the pss peers from the json configuration file
+func loadPeers(path string) ([]*bzz.PssPeer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg pssConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var peers []*bzz.PssPeer
+	for i, p := range cfg.Peers {
+		pubkey, err := hexutil.Decode(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: invalid public key: %v", i, err)
+		}
+		var addr []byte
+		if p.Address != "" {
+			addr, err = hexutil.Decode(p.Address)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid address: %v", i, err)
+			}
+		}
+		var topic pss.Topic
+		if strings.Contains(p.Topic, ":") {
+			topic = pss.BytesToTopic([]byte(p.Topic))
+		} else {
+			topicbytes, err := hexutil.Decode(p.Topic)
+			if err != nil || len(topicbytes) != len(topic) {
+				return nil, fmt.Errorf("peer %d: invalid topic '%s'", i, p.Topic)
+			}
+			copy(topic[:], topicbytes)
+		}
+		peers = append(peers, &bzz.PssPeer{
+			Topic:   topic,
+			PubKey:  pubkey,
+			Address: addr,
+			Enode:   p.Enode,
+		})
+	}
+	return peers, nil
+}
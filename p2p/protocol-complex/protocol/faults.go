@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Faults delays and drops the protocol messages a node sends, to see how the protocol copes with a bad network
+//
+// It is shared by all peers of the node, and can be changed while the protocol runs. Without latency and loss set, messages pass untouched.
+// The messages to each peer are drawn from a random source of their own, seeded from the seed and the id of the peer, so the same seed gives the same faults for the same messages to a peer, however the sends to different peers interleave
+type Faults struct {
+	latency time.Duration // messages are delayed by a random time up to this
+	loss    float64       // the share of messages that is dropped
+	seed    int64
+	mu      sync.Mutex
+}
+
+// NewFaults creates Faults drawing from random sources seeded from the seed
+func NewFaults(seed int64) *Faults {
+	return &Faults{
+		seed: seed,
+	}
+}
+
+// Set changes the latency and loss of the messages sent from now on
+func (self *Faults) Set(latency time.Duration, loss float64) error {
+	if latency < 0 {
+		return fmt.Errorf("negative latency %v", latency)
+	} else if loss < 0 || loss > 1 {
+		return fmt.Errorf("loss %v not between 0 and 1", loss)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.latency = latency
+	self.loss = loss
+	return nil
+}
+
+// Get returns the current latency and loss
+func (self *Faults) Get() (time.Duration, float64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.latency, self.loss
+}
+
+// draw decides from the random source whether the next message is dropped, and otherwise how long it is delayed
+func (self *Faults) draw(rng *rand.Rand) (bool, time.Duration) {
+	latency, loss := self.Get()
+	if loss > 0 && rng.Float64() < loss {
+		return true, 0
+	}
+	if latency > 0 {
+		return false, time.Duration(rng.Int63n(int64(latency)))
+	}
+	return false, 0
+}
+
+// faultyMsgReadWriter applies the faults to the messages written to a single peer
+//
+// The messages are written one at a time, in the order they are sent, so each gets the same draw on every run with the same seed.
+// A delay is head-of-line latency: it holds up every later message to the peer as well, and messages are never reordered
+type faultyMsgReadWriter struct {
+	p2p.MsgReadWriter
+	faults *Faults
+	rand   *rand.Rand
+	mu     sync.Mutex
+}
+
+func newFaultyMsgReadWriter(rw p2p.MsgReadWriter, faults *Faults, id enode.ID) *faultyMsgReadWriter {
+	seed := faults.seed ^ int64(binary.BigEndian.Uint64(id[:8]))
+	return &faultyMsgReadWriter{
+		MsgReadWriter: rw,
+		faults:        faults,
+		rand:          rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (self *faultyMsgReadWriter) WriteMsg(msg p2p.Msg) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	drop, delay := self.faults.draw(self.rand)
+	if drop {
+		log.Trace("fault injection dropped message", "code", msg.Code)
+		return msg.Discard()
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return self.MsgReadWriter.WriteMsg(msg)
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// meteredMsgReadWriter counts the protocol traffic with a single peer
+type meteredMsgReadWriter struct {
+	p2p.MsgReadWriter
+	inBytes  metrics.Counter
+	outBytes metrics.Counter
+	inMsgs   metrics.Counter
+	outMsgs  metrics.Counter
+	names    []string
+}
+
+func newMeteredMsgReadWriter(rw p2p.MsgReadWriter, p *p2p.Peer) *meteredMsgReadWriter {
+	prefix := fmt.Sprintf("demo/peer/%s", p.ID().TerminalString())
+	m := &meteredMsgReadWriter{
+		MsgReadWriter: rw,
+		names: []string{
+			prefix + "/in/bytes",
+			prefix + "/out/bytes",
+			prefix + "/in/msgs",
+			prefix + "/out/msgs",
+		},
+	}
+	m.inBytes = metrics.GetOrRegisterCounter(m.names[0], nil)
+	m.outBytes = metrics.GetOrRegisterCounter(m.names[1], nil)
+	m.inMsgs = metrics.GetOrRegisterCounter(m.names[2], nil)
+	m.outMsgs = metrics.GetOrRegisterCounter(m.names[3], nil)
+	return m
+}
+
+func (self *meteredMsgReadWriter) ReadMsg() (p2p.Msg, error) {
+	msg, err := self.MsgReadWriter.ReadMsg()
+	if err == nil {
+		self.inBytes.Inc(int64(msg.Size))
+		self.inMsgs.Inc(1)
+	}
+	return msg, err
+}
+
+func (self *meteredMsgReadWriter) WriteMsg(msg p2p.Msg) error {
+	err := self.MsgReadWriter.WriteMsg(msg)
+	if err == nil {
+		self.outBytes.Inc(int64(msg.Size))
+		self.outMsgs.Inc(1)
+	}
+	return err
+}
+
+// close removes the peer's counters from the registry, so they don't pile up as peers come and go
+func (self *meteredMsgReadWriter) close() {
+	for _, name := range self.names {
+		metrics.DefaultRegistry.Unregister(name)
+	}
+}
@@ -2,34 +2,42 @@ package protocol
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"reflect"
 
 	"github.com/ethereum/go-ethereum/p2p/protocols"
 )
 
+// HandlerFunc handles one type of protocol message received from a peer
+type HandlerFunc func(msg interface{}, p *protocols.Peer) error
+
+// UnknownMessageError is returned by the dispatcher when there is no handler for a message
+type UnknownMessageError struct {
+	Code uint64
+	Type reflect.Type
+}
+
+func (e *UnknownMessageError) Error() string {
+	return fmt.Sprintf("no handler for message code %d (%v)", e.Code, e.Type)
+}
+
 // Every protocol that wants to send messages back to sender, must have a peer abstraction
 // this is because devp2p doesn't let us know about which peer is the sender
 type DemoPeer struct {
 	*protocols.Peer
-	skillsHandler  func(*Skills, *protocols.Peer) error
-	statusHandler  func(*Status, *protocols.Peer) error
-	requestHandler func(*Request, *protocols.Peer) error
-	resultHandler  func(*Result, *protocols.Peer) error
+	spec     *protocols.Spec
+	handlers map[reflect.Type]HandlerFunc
 }
 
 // Dispatcher for incoming messages
 func (self *DemoPeer) Handle(ctx context.Context, msg interface{}) error {
-	if typ, ok := msg.(*Skills); ok {
-		return self.skillsHandler(typ, self.Peer)
-	}
-	if typ, ok := msg.(*Status); ok {
-		return self.statusHandler(typ, self.Peer)
-	}
-	if typ, ok := msg.(*Request); ok {
-		return self.requestHandler(typ, self.Peer)
-	}
-	if typ, ok := msg.(*Result); ok {
-		return self.resultHandler(typ, self.Peer)
+	handler, ok := self.handlers[reflect.TypeOf(msg)]
+	if !ok {
+		code, _ := self.spec.GetCode(msg)
+		return &UnknownMessageError{
+			Code: code,
+			Type: reflect.TypeOf(msg),
+		}
 	}
-	return errors.New("unknown message type")
+	return handler(msg, self.Peer)
 }
@@ -1,8 +1,10 @@
 package protocol
 
 import (
-	"errors"
+	"fmt"
+	"reflect"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/protocols"
@@ -23,13 +25,22 @@ const (
 
 // variables shared between p2p.Protocol and protocols.Spec
 const (
-	protoName    = "demo"
-	protoVersion = 1
-	protoMax     = 2048
+	Name     = "demo"
+	Version  = 1
+	protoMax = 2048
 )
 
 type ID [8]byte
 
+// MarshalText encodes the id as hex, so it is readable in rpc calls
+func (id ID) MarshalText() ([]byte, error) {
+	return hexutil.Bytes(id[:]).MarshalText()
+}
+
+func (id *ID) UnmarshalText(input []byte) error {
+	return hexutil.UnmarshalFixedText("ID", input, id[:])
+}
+
 // Skills is a protocol message type
 //
 // It is an asynchronous handshake message, signaling the state the node is in.
@@ -72,63 +83,72 @@ type Result struct {
 	Hash  []byte
 }
 
-var (
-	Messages = []interface{}{
-		&Skills{},
-		&Status{},
-		&Request{},
-		&Result{},
-	}
-
-	Spec = &protocols.Spec{
-		Name:       protoName,
-		Version:    protoVersion,
-		MaxMsgSize: protoMax,
-		Messages:   Messages,
-	}
-)
-
 // The protocol object wraps the code that starts a protocol on a peer upon connection
 //
 // This implementation holds a callback function thats called upon a successful connection
 // Any logic needed to be performed in the context of the protocol's service should be put there
 type DemoProtocol struct {
-	Protocol       p2p.Protocol
-	SkillsHandler  func(*Skills, *protocols.Peer) error
-	StatusHandler  func(*Status, *protocols.Peer) error
-	RequestHandler func(*Request, *protocols.Peer) error
-	ResultHandler  func(*Result, *protocols.Peer) error
-	handler        func(interface{}) error
-	runHook        func(*protocols.Peer) error
+	Protocol p2p.Protocol
+	Spec     *protocols.Spec // built from the handlers by Init
+	messages []interface{}   // in the order the handlers were registered, which gives the message codes
+	handlers map[reflect.Type]HandlerFunc
+	runHook  func(*protocols.Peer) error
+	dropHook func(*protocols.Peer)
+	faults   *Faults // applied to the messages sent to every peer, optional
 }
 
-func NewDemoProtocol(runHook func(*protocols.Peer) error) (*DemoProtocol, error) {
+// The runHook is called when the protocol starts on a peer
+//
+// The dropHook is called when the protocol terminates on a peer, and may be nil
+func NewDemoProtocol(runHook func(*protocols.Peer) error, dropHook func(*protocols.Peer)) (*DemoProtocol, error) {
 	proto := &DemoProtocol{
 		Protocol: p2p.Protocol{
-			Name:    protoName,
-			Version: protoVersion,
-			Length:  4,
+			Name:    Name,
+			Version: Version,
 		},
-		runHook: runHook,
+		handlers: make(map[reflect.Type]HandlerFunc),
+		runHook:  runHook,
+		dropHook: dropHook,
 	}
 
 	return proto, nil
 }
 
+// SetFaults applies the faults to the messages sent to every peer the protocol runs on after the call
+func (self *DemoProtocol) SetFaults(faults *Faults) {
+	self.faults = faults
+}
+
+// Handle adds a message type to the protocol, with its handler
+//
+// The message type is given the same way as in the Messages of a spec, as a pointer to an empty message.
+// Message codes follow the order the handlers are added in, so it must be the same on every node
+func (self *DemoProtocol) Handle(msg interface{}, handler HandlerFunc) error {
+	typ := reflect.TypeOf(msg)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return fmt.Errorf("message type %T is not a pointer", msg)
+	} else if _, ok := self.handlers[typ]; ok {
+		return fmt.Errorf("message type %T already handled", msg)
+	}
+	self.messages = append(self.messages, msg)
+	self.handlers[typ] = handler
+	return nil
+}
+
+// Init builds the protocol spec from the message types added with Handle
+//
 // TODO: double-check if we need the Init detached
 func (self *DemoProtocol) Init() error {
-	if self.SkillsHandler == nil {
-		return errors.New("missing skills handler")
-	}
-	if self.StatusHandler == nil {
-		return errors.New("missing status handler")
-	}
-	if self.RequestHandler == nil {
-		return errors.New("missing request handler")
+	if len(self.messages) == 0 {
+		return fmt.Errorf("no message handlers")
 	}
-	if self.ResultHandler == nil {
-		return errors.New("missing response handler")
+	self.Spec = &protocols.Spec{
+		Name:       Name,
+		Version:    Version,
+		MaxMsgSize: protoMax,
+		Messages:   self.messages,
 	}
+	self.Protocol.Length = self.Spec.Length()
 	self.Protocol.Run = self.Run
 	return nil
 }
@@ -137,15 +157,22 @@ func (self *DemoProtocol) Init() error {
 //
 // It enters a loop that takes care of dispatching and receiving messages
 func (self *DemoProtocol) Run(p *p2p.Peer, rw p2p.MsgReadWriter) error {
-	pp := protocols.NewPeer(p, rw, Spec)
+	if self.faults != nil {
+		rw = newFaultyMsgReadWriter(rw, self.faults, p.ID())
+	}
+	mrw := newMeteredMsgReadWriter(rw, p)
+	defer mrw.close()
+	pp := protocols.NewPeer(p, mrw, self.Spec)
 	log.Info("running demo protocol on peer", "peer", pp, "self", self)
 	go self.runHook(pp)
 	dp := &DemoPeer{
-		Peer:           pp,
-		skillsHandler:  self.SkillsHandler,
-		statusHandler:  self.StatusHandler,
-		requestHandler: self.RequestHandler,
-		resultHandler:  self.ResultHandler,
+		Peer:     pp,
+		spec:     self.Spec,
+		handlers: self.handlers,
+	}
+	err := pp.Run(dp.Handle)
+	if self.dropHook != nil {
+		self.dropHook(pp)
 	}
-	return pp.Run(dp.Handle)
+	return err
 }
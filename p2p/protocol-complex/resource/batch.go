@@ -0,0 +1,241 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"../protocol"
+	"../service"
+)
+
+const (
+	defaultBatchSize    = 64
+	defaultBatchDelay   = time.Second * 30
+	defaultBatchTimeout = time.Minute * 2
+	defaultBatchConfirm = time.Minute * 10 // how long a published result is remembered, for the result store to pass it again
+	batchVersion        = 1
+)
+
+var errBatchSinkClosed = fmt.Errorf("batch sink closed")
+
+// Batch is the document a batch of results is uploaded as
+type Batch struct {
+	Version int                     `json:"version"`
+	Results []*service.ResultRecord `json:"results"`
+}
+
+// Publisher uploads content, and publishes updates of a feed
+type Publisher interface {
+	Upload(ctx context.Context, data []byte) ([]byte, error)
+	Update(ctx context.Context, data []byte) error
+}
+
+// Source gives the updates of a feed, and the content they point to
+type Source interface {
+	History(ctx context.Context) ([][]byte, error) // the data of every update, oldest first
+	Download(ctx context.Context, addr []byte) ([]byte, error)
+}
+
+// BatchSink collects results, and publishes them in batches
+//
+// Each batch is uploaded as a json document, and its address is published as the next update of the feed.
+// A batch is published when it is full, or when the delay has passed since the last one.
+// The sink only confirms a result once the batch it is in is published, so the result store keeps the result until then
+type BatchSink struct {
+	publisher Publisher
+	size      int
+	delay     time.Duration
+	results   []*service.ResultRecord   // results waiting for the next batch
+	queued    map[protocol.ID]bool      // ids of the results waiting or being published
+	published map[protocol.ID]time.Time // ids of the published results not yet confirmed, with the time they were published
+	closed    bool
+	mu        sync.Mutex
+	fullC     chan struct{}
+	quitC     chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewBatchSink starts a batch sink. A size or delay of 0 selects the default
+func NewBatchSink(publisher Publisher, size int, delay time.Duration) *BatchSink {
+	if size == 0 {
+		size = defaultBatchSize
+	}
+	if delay == 0 {
+		delay = defaultBatchDelay
+	}
+	self := &BatchSink{
+		publisher: publisher,
+		size:      size,
+		delay:     delay,
+		queued:    make(map[protocol.ID]bool),
+		published: make(map[protocol.ID]time.Time),
+		fullC:     make(chan struct{}, 1),
+		quitC:     make(chan struct{}),
+	}
+	self.wg.Add(1)
+	go self.run()
+	return self
+}
+
+// SinkFunc returns the result sink that adds the results to the batch, see Add
+func (self *BatchSink) SinkFunc() service.ResultSinkFunc {
+	return func(obj interface{}) error {
+		res, ok := obj.(*service.ResultRecord)
+		if !ok {
+			return fmt.Errorf("unknown result type %T", obj)
+		}
+		return self.Add(res)
+	}
+}
+
+// Add adds the result to the next batch, unless it is in one already
+//
+// It returns service.ErrResultPending until the batch with the result is published, and nil when the result is added again after that.
+// Once the sink is closed, results that were not published are refused
+func (self *BatchSink) Add(res *service.ResultRecord) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.published[res.Id]; ok {
+		delete(self.published, res.Id)
+		return nil
+	}
+	if self.closed {
+		return errBatchSinkClosed
+	}
+	if self.queued[res.Id] {
+		return service.ErrResultPending
+	}
+	self.queued[res.Id] = true
+	self.results = append(self.results, res)
+	if len(self.results) >= self.size {
+		select {
+		case self.fullC <- struct{}{}:
+		default:
+		}
+	}
+	return service.ErrResultPending
+}
+
+func (self *BatchSink) run() {
+	defer self.wg.Done()
+	timer := time.NewTimer(self.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-self.quitC:
+			return
+		case <-self.fullC:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		if err := self.Flush(); err != nil {
+			log.Warn("batch publish fail", "err", err)
+		}
+		timer.Reset(self.delay)
+	}
+}
+
+// Flush publishes the collected results right away
+//
+// If publishing fails the results are kept for the next attempt
+func (self *BatchSink) Flush() error {
+	self.mu.Lock()
+	results := self.results
+	self.results = nil
+	self.mu.Unlock()
+	if len(results) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultBatchTimeout)
+	defer cancel()
+	err := self.publish(ctx, results)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err != nil {
+		self.results = append(results, self.results...)
+		return err
+	}
+	now := time.Now()
+	for id, t := range self.published {
+		if now.Sub(t) > defaultBatchConfirm {
+			delete(self.published, id)
+		}
+	}
+	for _, res := range results {
+		delete(self.queued, res.Id)
+		self.published[res.Id] = now
+	}
+	log.Debug("published batch", "results", len(results))
+	return nil
+}
+
+func (self *BatchSink) publish(ctx context.Context, results []*service.ResultRecord) error {
+	data, err := json.Marshal(&Batch{
+		Version: batchVersion,
+		Results: results,
+	})
+	if err != nil {
+		return err
+	}
+	addr, err := self.publisher.Upload(ctx, data)
+	if err != nil {
+		return err
+	}
+	return self.publisher.Update(ctx, addr)
+}
+
+// Close stops the batch sink, and publishes the remaining results
+//
+// Results added after it are refused, unless they were published already
+func (self *BatchSink) Close() error {
+	close(self.quitC)
+	self.wg.Wait()
+	self.mu.Lock()
+	self.closed = true
+	self.mu.Unlock()
+	if err := self.Flush(); err != nil {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		return fmt.Errorf("%d results not published: %v", len(self.results), err)
+	}
+	return nil
+}
+
+// RetrieveResults walks the updates of a feed of batches, and returns every verified result in them, oldest first
+//
+// Results that fail verification are left out
+func RetrieveResults(ctx context.Context, src Source) ([]*service.ResultRecord, error) {
+	updates, err := src.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var results []*service.ResultRecord
+	for _, addr := range updates {
+		data, err := src.Download(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("batch %x download fail: %v", addr, err)
+		}
+		var batch Batch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, fmt.Errorf("batch %x invalid: %v", addr, err)
+		} else if batch.Version != batchVersion {
+			return nil, fmt.Errorf("batch %x has unknown version %d", addr, batch.Version)
+		}
+		for _, res := range batch.Results {
+			if !res.Verify() {
+				log.Warn("invalid result in batch", "batch", fmt.Sprintf("%x", addr), "id", fmt.Sprintf("%x", res.Id))
+				continue
+			}
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
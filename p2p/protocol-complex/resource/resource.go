@@ -2,63 +2,205 @@ package resource
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+)
 
-	"../protocol"
+const (
+	defaultRetries = 3
+	defaultBackoff = time.Second
 )
 
+// Client publishes updates to a swarm feed through the http api of a swarm gateway
+//
+// The feed is identified by its topic and the address of the key that signs the updates.
+// Requests that fail with a network error or a temporary gateway error are retried
 type Client struct {
-	url      string
-	resource string
-	client   *http.Client
-	ready    bool
+	Retries int           // how many times a failed request is retried
+	Backoff time.Duration // delay before the first retry, doubled after each one
+
+	url    string
+	feed   feed.Feed
+	signer feed.Signer
+	client *http.Client
 }
 
-func NewClient(bzzapi string, resource string) *Client {
+// NewClient creates a client for the feed with the given topic name, owned by the private key
+func NewClient(bzzapi string, topicName string, privkey *ecdsa.PrivateKey) (*Client, error) {
+	topic, err := feed.NewTopic(topicName, nil)
+	if err != nil {
+		return nil, err
+	}
+	signer := feed.NewGenericSigner(privkey)
 	return &Client{
-		client:   http.DefaultClient,
-		resource: resource,
-		url:      bzzapi,
+		Retries: defaultRetries,
+		Backoff: defaultBackoff,
+		client:  http.DefaultClient,
+		feed: feed.Feed{
+			Topic: topic,
+			User:  signer.Address(),
+		},
+		signer: signer,
+		url:    bzzapi,
+	}, nil
+}
+
+// Feed returns the feed the client publishes to
+func (b *Client) Feed() *feed.Feed {
+	return &b.feed
+}
+
+// statusError is an error response from the gateway
+type statusError struct {
+	op     string
+	code   int
+	status string
+	msg    []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s fail: %s: %s", e.op, e.status, bytes.TrimSpace(e.msg))
+}
+
+// temporary tells if the request may succeed when retried
+//
+// A conflict means the epoch of the update was taken in the meantime, so the update is retried with a new one
+func (e *statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusConflict || e.code == http.StatusTooManyRequests
+}
+
+// retry calls f until it succeeds, it fails with a permanent error, the retries are used up or the context is done
+func (b *Client) retry(ctx context.Context, f func() error) error {
+	backoff := b.Backoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if serr, ok := err.(*statusError); ok && !serr.temporary() {
+			return err
+		}
+		if i >= b.Retries || ctx.Err() != nil {
+			return err
+		}
+		log.Debug("gateway request fail, retrying", "err", err, "retry", i+1, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 }
-func (b *Client) createResource(data []byte) error {
-	_, err := b.client.Post(
-		fmt.Sprintf("%s/bzz-resource:/%s/raw/2", b.url, b.resource),
-		"contenxt-type: application/octet-stream",
-		bytes.NewBuffer(data),
-	)
-	if err == nil {
-		log.Debug("creating resource", "id", b.resource)
-		b.ready = true
+
+// do sends a request to the gateway, and returns the body of the response
+//
+// Any response other than 200 OK is returned as a statusError
+func (b *Client) do(ctx context.Context, op string, method string, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
 	}
-	return err
+	req, err := http.NewRequest(method, b.url+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{
+			op:     op,
+			code:   resp.StatusCode,
+			status: resp.Status,
+			msg:    data,
+		}
+	}
+	return data, nil
 }
 
-func (b *Client) updateResource(data []byte) error {
-	if !b.ready {
-		return b.createResource(data)
+// newRequest gets the template of the next update from the gateway
+//
+// The template holds the epoch the next update must be published in
+func (b *Client) newRequest(ctx context.Context) (*feed.Request, error) {
+	values := url.Values{}
+	b.feed.AppendValues(values)
+	values.Set("meta", "1")
+	body, err := b.do(ctx, "feed request", http.MethodGet, "/bzz-feed:/?"+values.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request := &feed.Request{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, fmt.Errorf("invalid feed request: %v", err)
 	}
-	_, err := b.client.Post(
-		fmt.Sprintf("%s/bzz-resource:/%s/raw", b.url, b.resource),
-		"content-type: application/octet-stream",
-		bytes.NewBuffer(data),
-	)
-	return err
+	return request, nil
 }
 
-func (b *Client) ResourceSinkFunc() func(interface{}) {
-	return func(obj interface{}) {
-		if res, ok := obj.(*protocol.Result); ok {
-			log.Debug("posting", "obj", fmt.Sprintf("%x", res.Hash))
-			if err := b.updateResource(res.Hash); err != nil {
-				log.Error("resource fail", "err", err, "hash", res.Hash)
-			}
-		}
+// Update publishes the data as the next update of the feed
+func (b *Client) Update(ctx context.Context, data []byte) error {
+	return b.retry(ctx, func() error {
+		return b.update(ctx, data)
+	})
+}
+
+func (b *Client) update(ctx context.Context, data []byte) error {
+	request, err := b.newRequest(ctx)
+	if err != nil {
+		return err
+	}
+	request.SetData(data)
+	if err := request.Sign(b.signer); err != nil {
+		return err
+	}
+
+	values := url.Values{}
+	body := request.AppendValues(values)
+	if _, err := b.do(ctx, "feed update", http.MethodPost, "/bzz-feed:/?"+values.Encode(), body); err != nil {
+		return err
 	}
+	log.Debug("feed updated", "topic", b.feed.Topic.Hex(), "user", b.feed.User.Hex(), "epoch", request.Epoch.Base())
+	return nil
 }
-func main() {
-	fmt.Println("vim-go")
+
+// Upload stores the data as raw content, and returns its address
+func (b *Client) Upload(ctx context.Context, data []byte) ([]byte, error) {
+	var addr []byte
+	err := b.retry(ctx, func() error {
+		body, err := b.do(ctx, "upload", http.MethodPost, "/bzz-raw:/", data)
+		if err != nil {
+			return err
+		}
+		addr = common.FromHex(strings.TrimSpace(string(body)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("upload returned no address")
+	}
+	return addr, nil
 }
@@ -0,0 +1,436 @@
+package resource
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	p2ptest "github.com/ethereum/go-ethereum/p2p/testing"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+
+	"../protocol"
+	"../service"
+	"./resourcetest"
+)
+
+func TestClientUpdate(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Feed().User != crypto.PubkeyToAddress(privkey.PublicKey) {
+		t.Fatalf("feed user mismatch, expected %x, got %x", crypto.PubkeyToAddress(privkey.PublicKey), client.Feed().User)
+	}
+
+	updates := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}
+	for _, data := range updates {
+		if err := client.Update(context.Background(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := gw.Updates(*client.Feed())
+	if len(got) != len(updates) {
+		t.Fatalf("expected %d updates, got %d", len(updates), len(got))
+	}
+	for i, data := range updates {
+		if !bytes.Equal(got[i], data) {
+			t.Fatalf("update %d mismatch, expected %x, got %x", i, data, got[i])
+		}
+	}
+}
+
+// the gateway must reject an update signed by another key than the one of the feed user
+func TestClientUpdateForged(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := client.newRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetData([]byte("foo"))
+	if err := request.Sign(feed.NewGenericSigner(otherkey)); err != nil {
+		t.Fatal(err)
+	}
+	request.Feed.User = client.Feed().User
+	values := url.Values{}
+	body := request.AppendValues(values)
+	resp, err := http.Post(srv.URL+"/bzz-feed:/?"+values.Encode(), "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected forged update to be rejected, got %s", resp.Status)
+	}
+}
+
+func TestClientUpdateFail(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	gw.SetFail(true)
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Backoff = time.Millisecond
+	if err := client.Update(context.Background(), []byte("foo")); err == nil {
+		t.Fatal("expected update to fail")
+	}
+}
+
+// temporary gateway errors are retried, until the retries are used up
+func TestClientUpdateRetry(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Backoff = time.Millisecond
+
+	gw.SetFailures(client.Retries)
+	if err := client.Update(context.Background(), []byte("foo")); err != nil {
+		t.Fatalf("expected update to succeed after %d retries, got %v", client.Retries, err)
+	}
+	gw.SetFailures(client.Retries + 1)
+	if err := client.Update(context.Background(), []byte("bar")); err == nil {
+		t.Fatal("expected update to fail when retries are used up")
+	}
+	if updates := gw.Updates(*client.Feed()); len(updates) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(updates))
+	}
+}
+
+// a cancelled context stops the retries
+func TestClientUpdateCancel(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	gw.SetFail(true)
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if err := client.Update(ctx, []byte("foo")); err == nil {
+		t.Fatal("expected update to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("update did not stop when the context was done, took %v", time.Since(start))
+	}
+}
+
+// results of a batch that fails to publish through the gateway are kept, and published with the next batch
+func TestBatchSinkClient(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	gw.SetFail(true)
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	privkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(srv.URL, "demo.test", privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retries = 0
+	sink := NewBatchSink(client, 10, time.Hour)
+	sinkFunc := sink.SinkFunc()
+	for i := byte(0); i < 2; i++ {
+		if err := sinkFunc(resourcetest.MineRecord(t, i, 4)); err != service.ErrResultPending {
+			t.Fatalf("expected result pending, got %v", err)
+		}
+	}
+	if err := sink.Flush(); err == nil {
+		t.Fatal("expected publish to fail")
+	}
+
+	gw.SetFail(false)
+	if err := sinkFunc(resourcetest.MineRecord(t, 2, 4)); err != service.ErrResultPending {
+		t.Fatalf("expected result pending, got %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	updates := gw.Updates(*client.Feed())
+	if len(updates) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(updates))
+	}
+	var batch Batch
+	if err := json.Unmarshal(gw.Content(updates[0]), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Results) != 3 {
+		t.Fatalf("expected 3 results in the batch, got %d", len(batch.Results))
+	}
+}
+
+// memFeed is an in-memory feed and content store
+type memFeed struct {
+	content map[string][]byte
+	updates [][]byte
+}
+
+func (self *memFeed) Upload(ctx context.Context, data []byte) ([]byte, error) {
+	h := sha256.Sum256(data)
+	self.content[string(h[:])] = data
+	return h[:], nil
+}
+
+func (self *memFeed) Update(ctx context.Context, data []byte) error {
+	self.updates = append(self.updates, data)
+	return nil
+}
+
+func (self *memFeed) History(ctx context.Context) ([][]byte, error) {
+	return self.updates, nil
+}
+
+func (self *memFeed) Download(ctx context.Context, addr []byte) ([]byte, error) {
+	data, ok := self.content[string(addr)]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return data, nil
+}
+
+func TestBatchSinkRetrieve(t *testing.T) {
+	mf := &memFeed{
+		content: make(map[string][]byte),
+	}
+	sink := NewBatchSink(mf, 2, time.Hour)
+	sinkFunc := sink.SinkFunc()
+
+	var records []*service.ResultRecord
+	for i := byte(0); i < 5; i++ {
+		records = append(records, resourcetest.MineRecord(t, i, 4))
+	}
+	forged := resourcetest.MineRecord(t, 5, 4)
+	forged.Hash[0]++
+
+	for _, r := range records[:4] {
+		sinkFunc(r)
+	}
+	sinkFunc(forged)
+	sinkFunc(records[4])
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mf.updates) == 0 {
+		t.Fatal("no batches published")
+	}
+
+	results, err := RetrieveResults(context.Background(), mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(records) {
+		t.Fatalf("expected %d results, got %d", len(records), len(results))
+	}
+	for i, r := range records {
+		if results[i].Id != r.Id || !bytes.Equal(results[i].Hash, r.Hash) {
+			t.Fatalf("result %d mismatch, expected %x, got %x", i, r.Id, results[i].Id)
+		}
+	}
+}
+
+// results passed to a batch sink are only let go of by the result store of the demo service once their batch is published
+func TestBatchSinkResultStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    bool
+		results int // results left in the store after the node stops
+		updates int // feed updates published
+	}{
+		{name: "published", results: 0, updates: 1},
+		{name: "gateway down", fail: true, results: 1, updates: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := resourcetest.NewGateway()
+			gw.SetFail(test.fail)
+			srv := httptest.NewServer(gw)
+			defer srv.Close()
+
+			privkey, err := crypto.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClient(srv.URL, "demo.test", privkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Retries = 0
+			sink := NewBatchSink(client, 10, time.Hour)
+
+			params := service.NewDemoParams(sink.SinkFunc(), nil)
+			params.Id = make([]byte, 32)
+			params.MaxDifficulty = 8
+			params.MaxJobs = 1
+			params.MaxTimePerJob = time.Second
+			params.DrainTimeout = time.Millisecond * 10
+			params.Source = service.NewQueueSource(0)
+			params.CloseSink = sink.Close
+			d, err := service.NewDemo(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the test peer requests a job, and never acknowledges the result
+			rec := resourcetest.MineRecord(t, 1, 4)
+			tester := p2ptest.NewProtocolTester(privkey, 1, d.Protocol().Run)
+			peer := tester.Nodes[0].ID()
+			err = tester.TestExchanges(
+				expectMsg(d, peer, &protocol.Skills{Difficulty: params.MaxDifficulty}),
+				p2ptest.Exchange{
+					Triggers: triggerMsg(d, peer, &protocol.Request{Id: rec.Id, Data: rec.Data, Difficulty: rec.Difficulty}).Triggers,
+					Expects:  expectMsg(d, peer, &protocol.Result{Id: rec.Id, Nonce: rec.Nonce, Hash: rec.Hash}).Expects,
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tester.Stop()
+
+			d.Stop()
+			var info *service.NodeInfo
+			for _, api := range d.APIs() {
+				if admin, ok := api.Service.(*service.DemoAdminAPI); ok {
+					info = admin.Info()
+				}
+			}
+			if info.Results != test.results {
+				t.Fatalf("expected %d results in the store, got %d", test.results, info.Results)
+			}
+			if updates := gw.Updates(*client.Feed()); len(updates) != test.updates {
+				t.Fatalf("expected %d updates, got %d", test.updates, len(updates))
+			}
+		})
+	}
+}
+
+func triggerMsg(d *service.Demo, peer enode.ID, msg interface{}) p2ptest.Exchange {
+	code, _ := d.Spec().GetCode(msg)
+	return p2ptest.Exchange{
+		Triggers: []p2ptest.Trigger{{Code: code, Msg: msg, Peer: peer}},
+	}
+}
+
+func expectMsg(d *service.Demo, peer enode.ID, msg interface{}) p2ptest.Exchange {
+	code, _ := d.Spec().GetCode(msg)
+	return p2ptest.Exchange{
+		Expects: []p2ptest.Expect{{Code: code, Msg: msg, Peer: peer}},
+	}
+}
+
+// the walk finds every update published in the epochs a feed publisher chooses, also several in the same second, and nothing else
+func TestWalkEpoch(t *testing.T) {
+	start := uint64(1540000000)
+	times := []uint64{start, start, start + 1, start + 1, start + 1, start + 100, start + 5000, start + 1<<20}
+	published := make(map[lookup.Epoch]bool)
+	epoch := lookup.GetFirstEpoch(times[0])
+	for i, now := range times {
+		if i > 0 {
+			epoch = lookup.GetNextEpoch(epoch, now)
+		}
+		published[lookup.Epoch{Time: epoch.Base(), Level: epoch.Level}] = true
+	}
+
+	var mu sync.Mutex
+	found := make(map[lookup.Epoch]bool)
+	get := func(ctx context.Context, epoch lookup.Epoch) (bool, error) {
+		key := lookup.Epoch{Time: epoch.Base(), Level: epoch.Level}
+		if !published[key] {
+			return false, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if found[key] {
+			return false, fmt.Errorf("epoch %d/%d walked twice", key.Time, key.Level)
+		}
+		found[key] = true
+		return true, nil
+	}
+	span := uint64(1) << lookup.HighestLevel
+	ok, err := WalkEpoch(context.Background(), lookup.Epoch{Time: start &^ (span - 1), Level: lookup.HighestLevel}, times[len(times)-1], get)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected the top level epoch to have an update")
+	}
+	if len(found) != len(published) {
+		t.Fatalf("expected %d updates, found %d", len(published), len(found))
+	}
+}
+
+// an error of a lookup anywhere in the walk fails the walk
+func TestWalkEpochFail(t *testing.T) {
+	get := func(ctx context.Context, epoch lookup.Epoch) (bool, error) {
+		if epoch.Level < lookup.HighestLevel-2 {
+			return false, fmt.Errorf("lookup fail")
+		}
+		return true, nil
+	}
+	if _, err := WalkEpoch(context.Background(), lookup.Epoch{Level: lookup.HighestLevel}, 1<<lookup.HighestLevel, get); err == nil {
+		t.Fatal("expected walk to fail")
+	}
+}
@@ -0,0 +1,244 @@
+package resourcetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+
+	"../../service"
+	"../../service/minipow"
+)
+
+const (
+	feedPath = "/bzz-feed:/"
+	rawPath  = "/bzz-raw:/"
+
+	chunkHeaderLength = 8
+)
+
+// Gateway stands in for the endpoints of a swarm gateway that the feed client and retriever use
+//
+// It hands out the epoch of the next update on bzz-feed:, and only accepts updates that are correctly signed and in that epoch.
+// Content posted to bzz-raw: is kept by its sha256 hash, and served by hex address.
+// The chunks of the updates are kept too, and handed out by Chunk, as a node does over rpc with feed_chunk
+type Gateway struct {
+	mu       sync.Mutex
+	last     map[feed.Feed]lookup.Epoch
+	updates  map[feed.Feed][][]byte
+	content  map[string][]byte
+	chunks   map[string][]byte
+	fail     bool // if set, every request fails
+	failures int  // number of requests to fail before serving again
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{
+		last:    make(map[feed.Feed]lookup.Epoch),
+		updates: make(map[feed.Feed][][]byte),
+		content: make(map[string][]byte),
+		chunks:  make(map[string][]byte),
+	}
+}
+
+// SetFail makes every request fail until it is unset
+func (self *Gateway) SetFail(fail bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.fail = fail
+}
+
+// SetFailures makes the next n requests fail with a temporary error
+func (self *Gateway) SetFailures(n int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.failures = n
+}
+
+// Updates returns the data of the updates accepted for the feed, in order
+func (self *Gateway) Updates(fd feed.Feed) [][]byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([][]byte{}, self.updates[fd]...)
+}
+
+// Content returns the content at the address, or nil if none was uploaded
+func (self *Gateway) Content(addr []byte) []byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.content[hex.EncodeToString(addr)]
+}
+
+// Chunk returns the update chunk at the address, or nil if there is none
+func (self *Gateway) Chunk(addr []byte) []byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.chunks[hex.EncodeToString(addr)]
+}
+
+// Upload stores the content as if posted to bzz-raw:, and returns its address
+func (self *Gateway) Upload(data []byte) []byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.upload(data)
+}
+
+func (self *Gateway) upload(data []byte) []byte {
+	h := sha256.Sum256(data)
+	self.content[hex.EncodeToString(h[:])] = data
+	return h[:]
+}
+
+// Publish signs an update of the feed in the epoch with the key, and stores its chunk
+//
+// The epoch is not checked, so updates can be laid out as a feed publisher over any stretch of time would have
+func (self *Gateway) Publish(t testing.TB, fd feed.Feed, epoch lookup.Epoch, data []byte, key *ecdsa.PrivateKey) {
+	request := &feed.Request{}
+	request.Feed = fd
+	request.Epoch = epoch
+	request.SetData(data)
+	if err := request.Sign(feed.NewGenericSigner(key)); err != nil {
+		t.Fatal(err)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err := self.putChunk(request, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putChunk stores the chunk of a signed update under its address
+func (self *Gateway) putChunk(request *feed.Request, data []byte) error {
+	epochBytes, err := request.Epoch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, chunkHeaderLength)
+	chunk = append(chunk, request.Feed.Topic[:]...)
+	chunk = append(chunk, request.Feed.User[:]...)
+	chunk = append(chunk, epochBytes...)
+	chunk = append(chunk, data...)
+	chunk = append(chunk, request.Signature[:]...)
+	self.chunks[hex.EncodeToString(request.ID.Addr())] = chunk
+	return nil
+}
+
+func (self *Gateway) nextEpoch(fd feed.Feed) lookup.Epoch {
+	now := uint64(time.Now().Unix())
+	last, ok := self.last[fd]
+	if !ok {
+		return lookup.GetFirstEpoch(now)
+	}
+	return lookup.GetNextEpoch(last, now)
+}
+
+func (self *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.fail {
+		http.Error(w, "gateway down", http.StatusInternalServerError)
+		return
+	}
+	if self.failures > 0 {
+		self.failures--
+		http.Error(w, "gateway busy", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.URL.Path == feedPath:
+		self.serveFeed(w, r)
+	case r.URL.Path == rawPath && r.Method == http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%x", self.upload(data))
+	case strings.HasPrefix(r.URL.Path, rawPath):
+		data, ok := self.content[strings.TrimPrefix(r.URL.Path, rawPath)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (self *Gateway) serveFeed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		var fd feed.Feed
+		if err := fd.FromValues(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := &feed.Request{}
+		request.Feed = fd
+		request.Epoch = self.nextEpoch(fd)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(request)
+
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request feed.Request
+		if err := request.FromValues(query, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := request.Verify(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if request.Epoch != self.nextEpoch(request.Feed) {
+			http.Error(w, "wrong epoch", http.StatusConflict)
+			return
+		}
+		if err := self.putChunk(&request, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		self.last[request.Feed] = request.Epoch
+		self.updates[request.Feed] = append(self.updates[request.Feed], data)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MineRecord mines a result record over four bytes of n at the difficulty
+func MineRecord(t testing.TB, n byte, difficulty uint8) *service.ResultRecord {
+	data := []byte{n, n, n, n}
+	workData := make([]byte, len(data)+8)
+	copy(workData, data)
+	resultC := make(chan []byte, 1)
+	go minipow.Mine(workData, int(difficulty), resultC, make(chan struct{}), nil)
+	hash := <-resultC
+	if hash == nil {
+		t.Fatal("mining failed")
+	}
+	return &service.ResultRecord{
+		Id:         [8]byte{n},
+		Data:       data,
+		Nonce:      workData[len(data):],
+		Hash:       hash,
+		Difficulty: difficulty,
+		Worker:     []byte{0x2a},
+	}
+}
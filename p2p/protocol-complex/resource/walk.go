@@ -0,0 +1,79 @@
+package resource
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+)
+
+const defaultWalkConcurrency = 32
+
+// EpochFunc looks up the update of a feed in the epoch, and tells whether there is one
+//
+// It is called from several goroutines at once
+type EpochFunc func(ctx context.Context, epoch lookup.Epoch) (bool, error)
+
+// WalkEpoch walks the epoch and the epochs below it, and tells whether the epoch has an update
+//
+// An update is only ever published in an epoch below another update, so the walk stops at empty epochs, and at epochs starting after the time to.
+// Both child epochs are looked up at once, so a walk takes as many rounds of lookups as there are levels below the epoch, however many updates it finds
+func WalkEpoch(ctx context.Context, epoch lookup.Epoch, to uint64, get EpochFunc) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &epochWalker{
+		to:     to,
+		get:    get,
+		sem:    make(chan struct{}, defaultWalkConcurrency),
+		cancel: cancel,
+	}
+	found, err := w.walk(ctx, epoch)
+	if err != nil {
+		return false, err
+	}
+	return found, w.err
+}
+
+type epochWalker struct {
+	to     uint64
+	get    EpochFunc
+	sem    chan struct{} // limits the lookups in progress
+	mu     sync.Mutex
+	err    error // the first error of a walk below the epoch
+	cancel func()
+}
+
+func (self *epochWalker) walk(ctx context.Context, epoch lookup.Epoch) (bool, error) {
+	self.sem <- struct{}{}
+	found, err := self.get(ctx, epoch)
+	<-self.sem
+	if err != nil || !found || epoch.Level == lookup.LowestLevel {
+		return found, err
+	}
+	level := epoch.Level - 1
+	var wg sync.WaitGroup
+	for _, t := range []uint64{epoch.Base(), epoch.Base() + 1<<level} {
+		if t > self.to {
+			break
+		}
+		wg.Add(1)
+		go func(child lookup.Epoch) {
+			defer wg.Done()
+			if _, err := self.walk(ctx, child); err != nil {
+				self.fail(err)
+			}
+		}(lookup.Epoch{Time: t, Level: level})
+	}
+	wg.Wait()
+	return true, nil
+}
+
+// fail records the first error below the epoch, and stops the walk
+func (self *epochWalker) fail(err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.err == nil {
+		self.err = err
+		self.cancel()
+	}
+}
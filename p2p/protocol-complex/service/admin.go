@@ -0,0 +1,162 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// DemoAdminAPI lets the operator inspect and control the node at runtime
+type DemoAdminAPI struct {
+	service *Demo
+}
+
+func newDemoAdminAPI(s *Demo) *DemoAdminAPI {
+	return &DemoAdminAPI{
+		service: s,
+	}
+}
+
+// NodeInfo describes the current state of the node
+type NodeInfo struct {
+	Worker        bool   `json:"worker"`
+	Running       bool   `json:"running"`
+	Draining      bool   `json:"draining"`
+	MaxDifficulty uint8  `json:"maxDifficulty"`
+	MaxJobs       int    `json:"maxJobs"`
+	CurrentJobs   int    `json:"currentJobs"`
+	MaxTimePerJob string `json:"maxTimePerJob"`
+	Results       int    `json:"results"`
+	Peers         int    `json:"peers"`
+}
+
+// WorkerInfo describes a connected peer and the skills it has advertised
+type WorkerInfo struct {
+	Id         enode.ID `json:"id"`
+	Difficulty uint8    `json:"difficulty"`
+	MaxSize    uint16   `json:"maxSize"`
+}
+
+func (self *DemoAdminAPI) Info() *NodeInfo {
+	self.service.mu.RLock()
+	defer self.service.mu.RUnlock()
+	return &NodeInfo{
+		Worker:        self.service.IsWorker(),
+		Running:       self.service.running,
+		Draining:      self.service.draining,
+		MaxDifficulty: self.service.maxDifficulty,
+		MaxJobs:       self.service.maxJobs,
+		CurrentJobs:   self.service.currentJobs,
+		MaxTimePerJob: self.service.maxTimePerJob.String(),
+		Results:       self.service.results.Count(),
+		Peers:         len(self.service.peers),
+	}
+}
+
+// Workers lists the connected peers that have advertised their skills
+//
+// Peers in moocher mode are included, with a difficulty of 0
+func (self *DemoAdminAPI) Workers() []*WorkerInfo {
+	self.service.mu.RLock()
+	defer self.service.mu.RUnlock()
+	workers := make([]*WorkerInfo, 0, len(self.service.workers))
+	for p, skills := range self.service.workers {
+		workers = append(workers, &WorkerInfo{
+			Id:         p.ID(),
+			Difficulty: skills.Difficulty,
+			MaxSize:    skills.MaxSize,
+		})
+	}
+	return workers
+}
+
+// SetMaxJobs changes the maximum number of simultaneous hashing jobs the node will accept
+//
+// Jobs already running are not affected
+func (self *DemoAdminAPI) SetMaxJobs(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid max jobs %d", n)
+	}
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	self.service.maxJobs = n
+	return nil
+}
+
+// SetMaxTimePerJob changes the maximum time one hashing job will run
+//
+// The time is given as a duration string, for example "1500ms". Jobs already running are not affected
+func (self *DemoAdminAPI) SetMaxTimePerJob(d string) error {
+	t, err := time.ParseDuration(d)
+	if err != nil {
+		return err
+	} else if t <= 0 {
+		return fmt.Errorf("invalid max time per job %s", d)
+	}
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	self.service.maxTimePerJob = t
+	return nil
+}
+
+// SetWorker puts the node in worker mode, accepting jobs up to the given difficulty
+func (self *DemoAdminAPI) SetWorker(difficulty uint8) error {
+	if difficulty == 0 {
+		return fmt.Errorf("worker difficulty must be greater than 0")
+	}
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	self.service.setDifficulty(difficulty)
+	return nil
+}
+
+// SetMoocher puts the node in moocher mode, submitting jobs instead of accepting them
+func (self *DemoAdminAPI) SetMoocher() error {
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	self.service.setDifficulty(0)
+	return nil
+}
+
+// SetFaults delays and drops the protocol messages the node sends, to see how the network copes with a bad node
+//
+// The latency is given as a duration string, for example "200ms", and every message is delayed by a random time up to it.
+// Loss is the share of messages that is dropped, from 0 to 1. Both 0 turns the faults off
+func (self *DemoAdminAPI) SetFaults(latency string, loss float64) error {
+	d, err := time.ParseDuration(latency)
+	if err != nil {
+		return err
+	}
+	return self.service.faults.Set(d, loss)
+}
+
+// Pause stops the node from submitting jobs
+//
+// Results of jobs already submitted are still accepted
+func (self *DemoAdminAPI) Pause() {
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	self.service.running = false
+}
+
+// Resume lets a paused node submit jobs again
+func (self *DemoAdminAPI) Resume() error {
+	self.service.mu.Lock()
+	defer self.service.mu.Unlock()
+	if self.service.draining {
+		return fmt.Errorf("node is draining")
+	}
+	self.service.running = true
+	return nil
+}
+
+// Stats returns the job counts of the node since it started
+func (self *DemoAdminAPI) Stats() *Stats {
+	return self.service.stats.snapshot()
+}
+
+// Results returns the verified results of the jobs the node submitted, as far as they are still cached
+func (self *DemoAdminAPI) Results() []*ResultRecord {
+	return self.service.submits.Records()
+}
@@ -1,9 +1,16 @@
 package service
 
 import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rpc"
+
 	"../protocol"
 )
 
+const defaultResultSubscriptionBuffer = 64
+
 type DemoAPI struct {
 	service *Demo
 }
@@ -18,14 +25,80 @@ func (self *DemoAPI) Submit(data []byte, difficulty uint8) (protocol.ID, error)
 	return self.service.submitRequest(data, difficulty)
 }
 
-func (self *DemoAPI) Stop() error {
-	//self.service.running = false
-	return nil
+// SubmitBatch submits several payloads with the same difficulty
+//
+// Submission stops at the first failure, in which case the ids of the jobs submitted so far are returned with the error
+func (self *DemoAPI) SubmitBatch(data [][]byte, difficulty uint8) ([]protocol.ID, error) {
+	var ids []protocol.ID
+	for _, d := range data {
+		id, err := self.service.submitRequest(d, difficulty)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GetResult returns the verified result of a job submitted by this node
+//
+// The result is nil if the job is still pending
+func (self *DemoAPI) GetResult(id protocol.ID) (*JobResult, error) {
+	res, ok := self.service.submits.GetResult(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown job %x", id)
+	}
+	return res, nil
+}
+
+// Results streams the verified results of jobs submitted by this node
+//
+// Over rpc it is subscribed to with demo_subscribe("results"), as subscriptions are named after their method. Each subscriber gets its own buffered channel, so the results are sent without holding up the protocol
+func (self *DemoAPI) Results(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, ok := rpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	go func() {
+		resultC := make(chan *JobResult, defaultResultSubscriptionBuffer)
+		feedSub := self.service.resultFeed.Subscribe(resultC)
+		defer feedSub.Unsubscribe()
+		for {
+			select {
+			case res := <-resultC:
+				notifier.Notify(sub.ID, res)
+			case <-sub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// Enqueue adds a job to the service's job queue
+//
+// It requires the service to be configured with a QueueSource
+func (self *DemoAPI) Enqueue(data []byte, difficulty uint8) error {
+	queue, ok := self.service.source.(*QueueSource)
+	if !ok {
+		return fmt.Errorf("job source is not a queue")
+	}
+	return queue.Push(data, difficulty)
+}
+
+// Drain stops the service from taking new jobs, and returns once the running jobs and their results are settled
+//
+// The service itself is stopped with the node
+func (self *DemoAPI) Drain() {
+	self.service.Drain()
 }
 
 func (self *DemoAPI) SetDifficulty(d uint8) error {
 	self.service.mu.Lock()
 	defer self.service.mu.Unlock()
-	self.service.maxDifficulty = d
+	self.service.setDifficulty(d)
 	return nil
 }
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// metrics are only collected when the metrics flag is given on the command line, see go-ethereum/metrics
+var (
+	// worker side
+	jobsRequestedCounter          = metrics.NewRegisteredCounter("demo/jobs/requested", nil)
+	jobsAcceptedCounter           = metrics.NewRegisteredCounter("demo/jobs/accepted", nil)
+	jobsRejectedBusyCounter       = metrics.NewRegisteredCounter("demo/jobs/rejected/busy", nil)
+	jobsRejectedFullCounter       = metrics.NewRegisteredCounter("demo/jobs/rejected/full", nil)
+	jobsRejectedDrainingCounter   = metrics.NewRegisteredCounter("demo/jobs/rejected/draining", nil)
+	jobsRejectedDifficultyCounter = metrics.NewRegisteredCounter("demo/jobs/rejected/difficulty", nil)
+	jobsCompletedCounter          = metrics.NewRegisteredCounter("demo/jobs/completed", nil)
+	jobsGaveupCounter             = metrics.NewRegisteredCounter("demo/jobs/gaveup", nil)
+	resultStoreGauge              = metrics.NewRegisteredGauge("demo/results/stored", nil)
+	resultsUndeliveredCounter     = metrics.NewRegisteredCounter("demo/results/undelivered", nil)
+	resultsUnpublishedCounter     = metrics.NewRegisteredCounter("demo/results/unpublished", nil)
+
+	// moocher side
+	resultsVerifiedCounter = metrics.NewRegisteredCounter("demo/results/verified", nil)
+	resultsInvalidCounter  = metrics.NewRegisteredCounter("demo/results/invalid", nil)
+
+	// both
+	sendFailCounter = metrics.NewRegisteredCounter("demo/send/fail", nil)
+)
+
+// upper bounds of the mining time buckets, in seconds
+var miningBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 2, 5, 10, 30, 60}
+
+var (
+	miningHistogramsMu sync.Mutex
+	miningHistograms   = make(map[uint8]*histogram)
+)
+
+// histogram counts observations in buckets, to be exported as a prometheus histogram
+//
+// The timers of go-ethereum only keep a sample of their values, which gives quantiles but no exact bucket counts
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // upper bounds of the buckets
+	counts []uint64  // observations up to each bound, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (self *histogram) observe(v float64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for i, b := range self.bounds {
+		if v <= b {
+			self.counts[i]++
+			break
+		}
+	}
+	self.sum += v
+	self.count++
+}
+
+// write writes the histogram in the prometheus text format, with cumulative buckets
+func (self *histogram) write(w io.Writer, name string, labels string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var n uint64
+	for i, b := range self.bounds {
+		n += self.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, self.count)
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %f\n%s_count%s %d\n", name, labels, self.sum, name, labels, self.count)
+}
+
+// observeMining records the duration of a hashing job of the difficulty, if metrics are enabled
+func observeMining(difficulty uint8, d time.Duration) {
+	if !metrics.Enabled {
+		return
+	}
+	miningHistogramsMu.Lock()
+	h, ok := miningHistograms[difficulty]
+	if !ok {
+		h = newHistogram(miningBuckets)
+		miningHistograms[difficulty] = h
+	}
+	miningHistogramsMu.Unlock()
+	h.observe(d.Seconds())
+}
+
+// writeMining writes the mining time of all difficulties as one histogram, labelled by difficulty
+func writeMining(w io.Writer) {
+	miningHistogramsMu.Lock()
+	var difficulties []int
+	hs := make(map[int]*histogram)
+	for d, h := range miningHistograms {
+		difficulties = append(difficulties, int(d))
+		hs[int(d)] = h
+	}
+	miningHistogramsMu.Unlock()
+	if len(difficulties) == 0 {
+		return
+	}
+	sort.Ints(difficulties)
+	fmt.Fprintf(w, "# TYPE demo_mining_seconds histogram\n")
+	for _, d := range difficulties {
+		hs[d].write(w, "demo_mining_seconds", fmt.Sprintf("difficulty=\"%d\",", d))
+	}
+}
+
+// NewMetricsHandler serves the metrics in the registry in the prometheus text format
+//
+// Timers are exported as summaries, with their duration in nanoseconds.
+// The mining time is kept outside the registry, and exported with it as a histogram in seconds
+func NewMetricsHandler(r metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var names []string
+		all := make(map[string]interface{})
+		r.Each(func(name string, i interface{}) {
+			names = append(names, name)
+			all[name] = i
+		})
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, name := range names {
+			pname := strings.NewReplacer("/", "_", ".", "_", "-", "_").Replace(name)
+			switch m := all[name].(type) {
+			case metrics.Counter:
+				fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", pname, pname, m.Count())
+			case metrics.Gauge:
+				fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", pname, pname, m.Value())
+			case metrics.Meter:
+				fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", pname, pname, m.Count())
+			case metrics.Timer:
+				t := m.Snapshot()
+				ps := t.Percentiles([]float64{0.5, 0.9, 0.99})
+				fmt.Fprintf(w, "# TYPE %s summary\n", pname)
+				fmt.Fprintf(w, "%s{quantile=\"0.5\"} %f\n", pname, ps[0])
+				fmt.Fprintf(w, "%s{quantile=\"0.9\"} %f\n", pname, ps[1])
+				fmt.Fprintf(w, "%s{quantile=\"0.99\"} %f\n", pname, ps[2])
+				fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", pname, t.Sum(), pname, t.Count())
+			}
+		}
+		writeMining(w)
+	})
+}
@@ -12,3 +12,18 @@ func Check(hash []byte, data []byte, nonce []byte) bool {
 	h.Write(nonce)
 	return bytes.Equal(hash, h.Sum(nil))
 }
+
+// CheckDifficulty tells whether the hash has at least difficulty trailing zero bits, as Mine requires
+func CheckDifficulty(hash []byte, difficulty int) bool {
+	for i := len(hash) - 1; i >= 0 && difficulty > 0; i-- {
+		mask := byte(0xff)
+		if difficulty < 8 {
+			mask = byte(1<<uint(difficulty)) - 1
+		}
+		if hash[i]&mask != 0 {
+			return false
+		}
+		difficulty -= 8
+	}
+	return difficulty <= 0
+}
@@ -2,10 +2,17 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+
 	"../protocol"
+	"./minipow"
 )
 
 const (
@@ -13,52 +20,91 @@ const (
 	defaultResultsReleaseDelay = time.Second * 2
 )
 
-type ResultSinkFunc func(data interface{})
+// ResultSinkFunc is passed every expired result
+//
+// If it returns an error the result is kept in the store, and passed again after the release delay
+type ResultSinkFunc func(data interface{}) error
+
+// ErrResultPending is returned by a result sink that has taken a result, but not yet stored it for good
+//
+// The result is kept in the store and passed again after the release delay, as on any sink error, but it is not counted as unpublished
+var ErrResultPending = errors.New("result pending in sink")
+
+// ResultRecord is what the result sink gets for each expired result
+//
+// It holds everything needed to verify the job independently
+type ResultRecord struct {
+	Id         protocol.ID   `json:"id"`
+	Data       hexutil.Bytes `json:"data"`
+	Nonce      hexutil.Bytes `json:"nonce"`
+	Hash       hexutil.Bytes `json:"hash"`
+	Difficulty uint8         `json:"difficulty"`
+	Worker     hexutil.Bytes `json:"worker"` // id of the node that did the job
+}
+
+// Verify checks that the hash is over the data and the nonce, and meets the difficulty
+func (r *ResultRecord) Verify() bool {
+	return checkJob(r.Hash, r.Data, r.Nonce) && minipow.CheckDifficulty(r.Hash, int(r.Difficulty))
+}
 
 type resultEntry struct {
 	*protocol.Result
-	prid    protocol.ID // was result.ID?
-	expires time.Time
+	prid       protocol.ID // was result.ID?
+	data       []byte      // the data of the job
+	difficulty uint8
+	peer       *protocols.Peer // the peer that requested the job
+	delivered  bool            // false if the last attempt to send the result failed
+	sending    bool            // a send of the result is in progress
+	expires    time.Time
 }
 
 // TODO: revert to normal map instead of sync.Map
 type resultStore struct {
 	// handle results
-	entries      []*resultEntry // hashing nodes store the results here, while awaiting ack of reception by requester
-	idx          sync.Map       // index to look up resultentry by
-	counter      int            // amount of results stored in resultsCounter
-	capacity     int            // amount of results possible to store
-	releaseDelay time.Duration  // time before a result expires and should be passed to sinkFunc
-	sinkFunc     ResultSinkFunc // callback to pass data to when result has expired
+	entries      []*resultEntry               // hashing nodes store the results here, while awaiting ack of reception by requester
+	idx          sync.Map                     // index to look up resultentry by
+	counter      int                          // amount of results stored in resultsCounter
+	capacity     int                          // amount of results possible to store
+	releaseDelay time.Duration                // time before a result expires and should be passed to sinkFunc
+	sinkFunc     ResultSinkFunc               // callback to pass data to when result has expired
+	worker       []byte                       // id of this node, for the records passed to sinkFunc
+	sinking      map[protocol.ID]*resultEntry // results taken out of the store while sinkFunc is called
 
 	mu  sync.RWMutex
 	ctx context.Context
 }
 
-func newResultStore(ctx context.Context, sinkFunc ResultSinkFunc) *resultStore {
+func newResultStore(ctx context.Context, worker []byte, sinkFunc ResultSinkFunc) *resultStore {
 	return &resultStore{
 		entries: make([]*resultEntry, defaultResultsCapacity),
 		//idx:          make(map[protocol.ID]int),
 		releaseDelay: defaultResultsReleaseDelay,
 		capacity:     defaultResultsCapacity,
 		sinkFunc:     sinkFunc,
+		worker:       worker,
+		sinking:      make(map[protocol.ID]*resultEntry),
 		ctx:          ctx,
 	}
 }
 
-func (self *resultStore) Put(id protocol.ID, res *protocol.Result) bool {
+func (self *resultStore) Put(id protocol.ID, res *protocol.Result, p *protocols.Peer, data []byte, difficulty uint8) bool {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 	if self.full() {
 		return false
 	}
 	self.entries[self.counter] = &resultEntry{
-		Result:  res,
-		prid:    id,
-		expires: time.Now().Add(self.releaseDelay),
+		Result:     res,
+		prid:       id,
+		data:       data,
+		difficulty: difficulty,
+		peer:       p,
+		delivered:  true,
+		expires:    time.Now().Add(self.releaseDelay),
 	}
 	self.idx.Store(id, self.counter)
 	self.counter++
+	resultStoreGauge.Update(int64(self.counter))
 	return true
 }
 
@@ -79,16 +125,162 @@ func (self *resultStore) Del(id protocol.ID) {
 }
 
 func (self *resultStore) del(id protocol.ID) {
+	delete(self.sinking, id)
 	if n, ok := self.idx.Load(id); ok {
 		self.idx.Delete(id)
 		if self.counter == 0 { // reaches negative count unless this check, why?
 			return
 		}
 		self.counter--
-		if self.counter > 0 {
+		if n.(int) != self.counter {
 			self.entries[n.(int)] = self.entries[self.counter]
 			self.idx.Store(self.entries[n.(int)].prid, n.(int))
 		}
+		resultStoreGauge.Update(int64(self.counter))
+	}
+}
+
+// SetSending marks a send of the result as in progress
+//
+// It returns false if the result is no longer in the store, or a send of it is already in progress
+func (self *resultStore) SetSending(id protocol.ID) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n, ok := self.idx.Load(id)
+	if !ok || self.entries[n.(int)].sending {
+		return false
+	}
+	self.entries[n.(int)].sending = true
+	return true
+}
+
+// SetDelivered records whether the last attempt to send a result succeeded, and ends the send in progress
+func (self *resultStore) SetDelivered(id protocol.ID, delivered bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if n, ok := self.idx.Load(id); ok {
+		self.entries[n.(int)].delivered = delivered
+		self.entries[n.(int)].sending = false
+	}
+}
+
+// Pending returns a snapshot of the results that are still awaiting acknowledgement
+func (self *resultStore) Pending() []*resultEntry {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	entries := make([]*resultEntry, self.counter)
+	for i, e := range self.entries[:self.counter] {
+		c := *e
+		entries[i] = &c
+	}
+	return entries
+}
+
+// Flush empties the store, passing every remaining result to sinkFunc
+//
+// Results the sink fails to take are put back in the store, and the number of them is returned.
+// Results pending in the sink are put back too, but not counted, as the sink still has them
+func (self *resultStore) Flush() int {
+	entries := self.take(func(e *resultEntry) bool { return true })
+	var failed []*resultEntry
+	errored := make(map[*resultEntry]bool)
+	for _, e := range entries {
+		err := self.sink(e)
+		if err == ErrResultPending {
+			failed = append(failed, e)
+		} else if err != nil {
+			log.Warn("result sink fail", "id", fmt.Sprintf("%x", e.prid), "err", err)
+			failed = append(failed, e)
+			errored[e] = true
+		}
+	}
+	var kept int
+	for _, e := range self.settle(entries, failed) {
+		if errored[e] {
+			kept++
+		}
+	}
+	return kept
+}
+
+// take removes the results matching the filter from the store, so sinkFunc can be called on them without the lock
+//
+// They are held until settle, so an acknowledgement arriving meanwhile still removes them
+func (self *resultStore) take(filter func(e *resultEntry) bool) []*resultEntry {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var taken []*resultEntry
+	var kept int
+	for i := 0; i < self.counter; i++ {
+		e := self.entries[i]
+		if filter(e) {
+			taken = append(taken, e)
+			self.sinking[e.prid] = e
+			self.idx.Delete(e.prid)
+			continue
+		}
+		self.entries[kept] = e
+		self.idx.Store(e.prid, kept)
+		kept++
+	}
+	for i := kept; i < self.counter; i++ {
+		self.entries[i] = nil
+	}
+	self.counter = kept
+	resultStoreGauge.Update(int64(self.counter))
+	return taken
+}
+
+// settle ends the sinking of the results taken out of the store
+//
+// The failed ones are put back, to expire again after the release delay, unless they were acknowledged meanwhile or the store has filled up.
+// It returns the ones put back
+func (self *resultStore) settle(taken []*resultEntry, failed []*resultEntry) []*resultEntry {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var kept []*resultEntry
+	for _, e := range failed {
+		if _, ok := self.sinking[e.prid]; !ok {
+			continue
+		}
+		if self.full() {
+			log.Warn("result store full, dropping unpublished result", "id", fmt.Sprintf("%x", e.prid))
+			continue
+		}
+		e.expires = time.Now().Add(self.releaseDelay)
+		e.sending = false
+		self.entries[self.counter] = e
+		self.idx.Store(e.prid, self.counter)
+		self.counter++
+		kept = append(kept, e)
+	}
+	for _, e := range taken {
+		delete(self.sinking, e.prid)
+	}
+	resultStoreGauge.Update(int64(self.counter))
+	return kept
+}
+
+// sink passes the result to sinkFunc, if there is one
+func (self *resultStore) sink(e *resultEntry) error {
+	if self.sinkFunc == nil {
+		return nil
+	}
+	err := self.sinkFunc(self.record(e))
+	if err != nil && err != ErrResultPending {
+		resultsUnpublishedCounter.Inc(1)
+	}
+	return err
+}
+
+func (self *resultStore) record(e *resultEntry) *ResultRecord {
+	return &ResultRecord{
+		Id:         e.Id,
+		Data:       e.data,
+		Nonce:      e.Nonce,
+		Hash:       e.Hash,
+		Difficulty: e.difficulty,
+		Worker:     self.worker,
 	}
 }
 
@@ -123,21 +315,21 @@ func (self *resultStore) Start() {
 	}()
 }
 
-// TODO: this procedure needs priority control, so it doesn't block for too long
+// prune passes the expired results to sinkFunc, and removes them from the store
+//
+// The expired results are taken out under the lock, so a result acknowledged before is never published, and the sink is called without the lock held, as publishing may take a while.
+// Results it fails to take expire again after the release delay
 func (self *resultStore) prune() {
-	i := 0
-	self.idx.Range(func(k interface{}, n interface{}) bool {
-		i++
-		prid := k.(protocol.ID)
-		self.mu.Lock()
-		e := self.entries[n.(int)]
-		if e.expires.Before(time.Now()) {
-			self.del(prid)
-			if self.sinkFunc != nil {
-				self.sinkFunc(e.Result)
-			}
+	now := time.Now()
+	expired := self.take(func(e *resultEntry) bool { return e.expires.Before(now) })
+	var failed []*resultEntry
+	for _, e := range expired {
+		if err := self.sink(e); err == ErrResultPending {
+			failed = append(failed, e)
+		} else if err != nil {
+			log.Warn("result sink fail, keeping result", "id", fmt.Sprintf("%x", e.prid), "err", err)
+			failed = append(failed, e)
 		}
-		self.mu.Unlock()
-		return true
-	})
+	}
+	self.settle(expired, failed)
 }
@@ -5,10 +5,11 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
-	"math/rand"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/protocols"
@@ -17,33 +18,48 @@ import (
 	"../protocol"
 )
 
+const (
+	defaultDrainTimeout   = time.Second * 10
+	defaultDrainPollDelay = time.Millisecond * 100
+	defaultSendTimeout    = time.Second * 5
+	defaultRedeliverDelay = time.Millisecond * 500
+)
+
 // TODO: Change the id to sha1(peerid|data|submits.lastid), so moocher can find it in resource updates later
 // Demo implements the node.Service interface
 type Demo struct {
 
 	// a unique identifier used to track a request across messages
-	id      []byte
-	running bool
+	id           []byte
+	running      bool          // when not set, the node submits no jobs
+	draining     bool          // when set, the node accepts no new jobs
+	drainTimeout time.Duration // maximum time to wait for jobs and results to complete when draining
+	sendTimeout  time.Duration // maximum time a send may block before the peer is dropped
+	drainOnce    sync.Once
 
 	// worker mode params
-	maxJobs       int           // maximum number of simultaneous hashing jobs the node will accept
-	currentJobs   int           // how many jobs currently executing
-	maxDifficulty uint8         // the maximum difficulty of jobs this node will handle
-	maxTimePerJob time.Duration // maximum time one hashing job will run
+	maxJobs       int            // maximum number of simultaneous hashing jobs the node will accept
+	currentJobs   int            // how many jobs currently executing
+	jobs          sync.WaitGroup // tracks running hashing jobs, so we can wait for them when draining
+	maxDifficulty uint8          // the maximum difficulty of jobs this node will handle
+	maxTimePerJob time.Duration  // maximum time one hashing job will run
 
 	// moocher mode params
-	workers             map[*protocols.Peer]uint8 // an address book of hasher peers for nodes that send requests
-	submitDelay         time.Duration
-	submitDataSize      int
-	minSubmitDifficulty uint8
-	maxSubmitDifficulty uint8
+	workers map[*protocols.Peer]*protocol.Skills // an address book of hasher peers for nodes that send requests
+	source  JobSource                            // provides the jobs to submit
 
-	submits *submitStore
-	results *resultStore
-	save    SaveFunc
+	submits    *submitStore
+	results    *resultStore
+	closeSink  func() error // closes the result sink when the node stops
+	save       SaveFunc
+	resultFeed event.Feed // notifies subscribers of verified results of jobs we submitted
+	stats      stats
+	faults     *protocol.Faults // applied to the messages sent to peers, set through the admin api
 
 	// internal stuff
+	peers    map[*protocols.Peer]struct{} // all peers the protocol is currently running on
 	protocol *p2p.Protocol
+	spec     *protocols.Spec
 	mu       sync.RWMutex
 	ctx      context.Context
 	cancel   func()
@@ -56,11 +72,15 @@ type DemoParams struct {
 	MaxDifficulty       uint8
 	MaxJobs             int
 	MaxTimePerJob       time.Duration
+	DrainTimeout        time.Duration
 	SubmitDelay         time.Duration
 	SubmitDataSize      int
 	MaxSubmitDifficulty uint8
 	MinSubmitDifficulty uint8
+	Source              JobSource // if nil, random jobs are generated from the Submit* params
+	FaultSeed           int64     // seeds the random choices of the faults set through the admin api
 	ResultSink          ResultSinkFunc
+	CloseSink           func() error // called when the node stops, after the remaining results are passed to ResultSink, which then gets them once more to confirm them, optional
 	Save                SaveFunc
 }
 
@@ -73,22 +93,32 @@ func NewDemoParams(sinkFunc ResultSinkFunc, saveFunc SaveFunc) *DemoParams {
 
 func NewDemo(params *DemoParams) (*Demo, error) {
 	ctx, cancel := context.WithCancel(context.Background())
+	drainTimeout := params.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	source := params.Source
+	if source == nil {
+		source = NewRandomSource(params.SubmitDataSize, params.SubmitDelay, params.MinSubmitDifficulty, params.MaxSubmitDifficulty)
+	}
 	d := &Demo{
-		id:                  params.Id,
-		running:             true,
-		maxJobs:             params.MaxJobs,
-		maxDifficulty:       params.MaxDifficulty,
-		maxTimePerJob:       params.MaxTimePerJob,
-		submitDelay:         params.SubmitDelay,
-		submitDataSize:      params.SubmitDataSize,
-		maxSubmitDifficulty: params.MaxSubmitDifficulty,
-		minSubmitDifficulty: params.MinSubmitDifficulty,
-		workers:             make(map[*protocols.Peer]uint8),
-		submits:             newSubmitStore(),
-		results:             newResultStore(ctx, params.ResultSink),
-		save:                params.Save,
-		ctx:                 ctx,
-		cancel:              cancel,
+		id:            params.Id,
+		running:       true,
+		drainTimeout:  drainTimeout,
+		sendTimeout:   defaultSendTimeout,
+		maxJobs:       params.MaxJobs,
+		maxDifficulty: params.MaxDifficulty,
+		maxTimePerJob: params.MaxTimePerJob,
+		workers:       make(map[*protocols.Peer]*protocol.Skills),
+		source:        source,
+		peers:         make(map[*protocols.Peer]struct{}),
+		submits:       newSubmitStore(),
+		results:       newResultStore(ctx, params.Id, params.ResultSink),
+		save:          params.Save,
+		closeSink:     params.CloseSink,
+		faults:        protocol.NewFaults(params.FaultSeed),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 	if err := d.initProtocol(); err != nil {
 		return nil, err
@@ -108,22 +138,49 @@ func (self *Demo) APIs() []rpc.API {
 			Service:   newDemoAPI(self),
 			Public:    true,
 		},
+		{
+			Namespace: "demoadmin",
+			Version:   "1.0",
+			Service:   newDemoAdminAPI(self),
+			Public:    false,
+		},
 	}
 }
 
 func (self *Demo) initProtocol() error {
-	proto, err := protocol.NewDemoProtocol(self.Run)
+	proto, err := protocol.NewDemoProtocol(self.Run, self.Drop)
 	if err != nil {
 		return fmt.Errorf("cant't create demo protocol")
 	}
-	proto.SkillsHandler = self.skillsHandlerLocked
-	proto.StatusHandler = self.statusHandlerLocked
-	proto.RequestHandler = self.requestHandlerLocked
-	proto.ResultHandler = self.resultHandlerLocked
+	// the order of the handlers gives the message codes
+	handlers := []struct {
+		msg     interface{}
+		handler protocol.HandlerFunc
+	}{
+		{&protocol.Skills{}, func(msg interface{}, p *protocols.Peer) error {
+			return self.skillsHandlerLocked(msg.(*protocol.Skills), p)
+		}},
+		{&protocol.Status{}, func(msg interface{}, p *protocols.Peer) error {
+			return self.statusHandlerLocked(msg.(*protocol.Status), p)
+		}},
+		{&protocol.Request{}, func(msg interface{}, p *protocols.Peer) error {
+			return self.requestHandlerLocked(msg.(*protocol.Request), p)
+		}},
+		{&protocol.Result{}, func(msg interface{}, p *protocols.Peer) error {
+			return self.resultHandlerLocked(msg.(*protocol.Result), p)
+		}},
+	}
+	for _, h := range handlers {
+		if err := proto.Handle(h.msg, h.handler); err != nil {
+			return fmt.Errorf("can't register demo protocol handler: %v", err)
+		}
+	}
+	proto.SetFaults(self.faults)
 	if err := proto.Init(); err != nil {
-		return fmt.Errorf("can't init demo protocol")
+		return fmt.Errorf("can't init demo protocol: %v", err)
 	}
 	self.protocol = &proto.Protocol
+	self.spec = proto.Spec
 	return nil
 }
 
@@ -132,7 +189,7 @@ func (self *Demo) Protocol() *p2p.Protocol {
 }
 
 func (self *Demo) Spec() *protocols.Spec {
-	return protocol.Spec
+	return self.spec
 }
 
 func (self *Demo) Protocols() (protos []p2p.Protocol) {
@@ -141,63 +198,218 @@ func (self *Demo) Protocols() (protos []p2p.Protocol) {
 
 func (self *Demo) Start(srv *p2p.Server) error {
 	self.results.Start()
+	go self.dispatch()
+	go self.redeliver()
 	return nil
 }
 
+// Stop drains the node before shutting it down
+//
+// Jobs still running after the drain are cancelled, and the results of those that finished meanwhile are passed to the result sink
 func (self *Demo) Stop() error {
-	log.Error(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>> RUNNING STOP")
+	self.Drain()
 	self.cancel()
+	if c, ok := self.source.(io.Closer); ok {
+		c.Close()
+	}
+	self.jobs.Wait()
+	kept := self.results.Flush()
+	if self.closeSink != nil {
+		if err := self.closeSink(); err != nil {
+			log.Error("result sink close fail", "err", err)
+		}
+		// results pending in the sink are only let go of once the sink confirms them
+		kept = self.results.Flush()
+	}
+	if kept > 0 {
+		log.Warn("results lost on stop", "results", kept)
+	}
 	return nil
 }
 
+// Drain prepares the node for shutdown
+//
+// The node announces to its peers that it no longer accepts jobs, and waits for running jobs to finish or time out.
+// Results still awaiting acknowledgement are then sent again to the peers that requested them.
+// Any results not acknowledged within the drain timeout are passed to the result sink.
+//
+// Subsequent calls have no effect
+func (self *Demo) Drain() {
+	self.drainOnce.Do(self.drain)
+}
+
+func (self *Demo) drain() {
+	self.mu.Lock()
+	self.draining = true
+	self.running = false
+	log.Info("draining demo service", "jobs", self.currentJobs, "results", self.results.Count(), "timeout", self.drainTimeout)
+	self.announceSkills()
+	self.mu.Unlock()
+
+	deadline := time.NewTimer(self.drainTimeout)
+	defer deadline.Stop()
+
+	// wait for the running jobs
+	jobsC := make(chan struct{})
+	go func() {
+		self.jobs.Wait()
+		close(jobsC)
+	}()
+	select {
+	case <-jobsC:
+	case <-deadline.C:
+		log.Warn("drain timeout with jobs still running")
+		self.results.Flush()
+		return
+	}
+
+	// deliver what we still have
+	for _, e := range self.results.Pending() {
+		go self.sendResult(e.peer, e.Result)
+	}
+	tick := time.NewTicker(defaultDrainPollDelay)
+	defer tick.Stop()
+	for self.results.Count() > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			log.Warn("drain timeout with undelivered results", "results", self.results.Count())
+			self.results.Flush()
+			return
+		}
+	}
+}
+
 // The protocol code provides Hook to run when protocol starts on a peer
 func (self *Demo) Run(p *protocols.Peer) error {
-	self.mu.RLock()
+	self.mu.Lock()
 	log.Info("run protocol hook", "peer", p, "difficulty", self.maxDifficulty)
-	self.mu.RUnlock()
+	self.peers[p] = struct{}{}
+	self.mu.Unlock()
 
 	go func(self *Demo, p *protocols.Peer) {
 		self.mu.RLock()
-		maxdifficulty := self.maxDifficulty
+		skills := self.skills()
 		self.mu.RUnlock()
-		p.Send(context.TODO(),
-			&protocol.Skills{
-				Difficulty: maxdifficulty,
-			},
-		)
-		if maxdifficulty > 0 {
-			return
-		}
-		data := make([]byte, self.submitDataSize)
-		tick := time.NewTicker(self.submitDelay)
-		for {
-			select {
-			case <-self.ctx.Done():
-				tick.Stop()
-				return
-			case <-tick.C:
+		self.send(p, skills)
+	}(self, p)
+	return nil
+}
+
+// skills returns the skills the node currently offers
+//
+// Must be called with lock held
+func (self *Demo) skills() *protocol.Skills {
+	if self.draining {
+		return &protocol.Skills{}
+	}
+	return &protocol.Skills{
+		Difficulty: self.maxDifficulty,
+	}
+}
+
+// announceSkills sends the skills the node currently offers to all connected peers
+//
+// Must be called with lock held
+func (self *Demo) announceSkills() {
+	skills := self.skills()
+	for p := range self.peers {
+		go self.send(p, skills)
+	}
+}
+
+// setDifficulty changes the maximum difficulty of jobs the node accepts, and tells the peers about it
+//
+// A difficulty of 0 puts the node in moocher mode.
+//
+// Must be called with lock held
+func (self *Demo) setDifficulty(d uint8) {
+	if self.maxDifficulty == d {
+		return
+	}
+	self.maxDifficulty = d
+	self.announceSkills()
+}
+
+// dispatch submits jobs from the job source while the node is in moocher mode
+//
+// There is only one dispatcher per service, regardless of how many peers are connected.
+// A job that can't be submitted is retried until a worker is available to take it.
+// The mode is checked before every attempt: the job is held while the node is paused or in worker mode, and dropped when it drains
+func (self *Demo) dispatch() {
+	var data []byte
+	var difficulty uint8
+	var pending bool // data holds a job not submitted yet
+	var err error
+	for {
+		self.mu.RLock()
+		draining := self.draining
+		idle := self.IsWorker() || draining || !self.running
+		self.mu.RUnlock()
+		if idle {
+			if pending && draining {
+				log.Warn("dropping job not submitted before drain", "difficulty", difficulty)
+				pending = false
 			}
-			_, err := rand.Read(data)
-			if err != nil {
+			if !self.wait(defaultDispatchIdleTime) {
 				return
 			}
-			self.mu.RLock()
-			difficulty := rand.Intn(int(self.maxSubmitDifficulty-self.minSubmitDifficulty)) + int(self.minSubmitDifficulty)
-			self.mu.RUnlock()
-			prid, err := self.submitRequest(data, uint8(difficulty))
-			if err != nil {
+			continue
+		}
+
+		if !pending {
+			data, difficulty, err = self.source.Next(self.ctx)
+			if err == io.EOF {
+				log.Info("job source exhausted")
+				return
+			} else if err != nil {
+				if self.ctx.Err() == nil {
+					log.Error("job source fail", "err", err)
+				}
 				return
 			}
+			pending = true
+		}
+
+		prid, err := self.submitRequest(data, difficulty)
+		if err == nil {
 			log.Debug("submitted job", "nid", fmt.Sprintf("%x", self.id[:8]), "prid", fmt.Sprintf("%x", prid))
+			pending = false
+			continue
+		}
+		log.Trace("submit job fail, retrying", "err", err)
+		if !self.wait(defaultDispatchIdleTime) {
+			return
 		}
+	}
+}
 
-	}(self, p)
-	return nil
+// wait blocks for the given duration
+//
+// It returns false if the service shuts down before the duration has passed
+func (self *Demo) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-self.ctx.Done():
+		return false
+	case <-timer.C:
+	}
+	return true
+}
+
+// The protocol code provides Hook to run when protocol terminates on a peer
+func (self *Demo) Drop(p *protocols.Peer) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	log.Info("drop protocol hook", "peer", p)
+	delete(self.peers, p)
+	delete(self.workers, p)
 }
 
 func (self *Demo) getNextWorker(difficulty uint8) *protocols.Peer {
-	for p, d := range self.workers {
-		if d >= difficulty {
+	for p, skills := range self.workers {
+		if skills.Difficulty >= difficulty {
 			return p
 		}
 	}
@@ -206,8 +418,13 @@ func (self *Demo) getNextWorker(difficulty uint8) *protocols.Peer {
 
 func (self *Demo) submitRequest(data []byte, difficulty uint8) (protocol.ID, error) {
 	self.mu.Lock()
+	if self.draining {
+		self.mu.Unlock()
+		return protocol.ID{}, fmt.Errorf("Node is draining, not submitting")
+	}
 	p := self.getNextWorker(difficulty)
 	if p == nil {
+		self.mu.Unlock()
 		return protocol.ID{}, fmt.Errorf("Couldn't find any workers for difficulty %d", difficulty)
 	}
 	id := newID(data, self.submits.IncSerial())
@@ -218,10 +435,12 @@ func (self *Demo) submitRequest(data []byte, difficulty uint8) (protocol.ID, err
 		Data:       data,
 		Difficulty: difficulty,
 	}
-	err := p.Send(context.TODO(), req)
+	err := self.send(p, req)
 	if err == nil {
 		if err := self.submits.Put(req, id); err != nil {
 			log.Error("submits put fail", "err", err)
+		} else {
+			self.stats.inc(func(s *Stats) { s.Submitted++ })
 		}
 	}
 	//}(id)
@@ -232,7 +451,7 @@ func (self *Demo) skillsHandlerLocked(msg *protocol.Skills, p *protocols.Peer) e
 	self.mu.Lock()
 	defer self.mu.Unlock()
 	log.Trace("have skills type", "msg", msg, "peer", p)
-	self.workers[p] = msg.Difficulty
+	self.workers[p] = msg
 	return nil
 }
 
@@ -246,76 +465,95 @@ func (self *Demo) statusHandlerLocked(msg *protocol.Status, p *protocols.Peer) e
 	case protocol.StatusThanksABunch:
 		if self.IsWorker() {
 			log.Debug("got thanks, how polite!", "msg", msg.Id)
+			if self.results.Get(msg.Id) != nil {
+				self.stats.inc(func(s *Stats) { s.Acknowledged++ })
+			}
 			self.results.Del(msg.Id)
 		}
 	case protocol.StatusBusy:
 		if self.IsWorker() {
 			return nil
 		}
+		self.reject(msg.Id)
 		log.Debug("peer is busy. please implement throttling")
 	case protocol.StatusAreYouKidding:
 		if self.IsWorker() {
 			return nil
 		}
+		self.reject(msg.Id)
 		log.Debug("we sent wrong difficulty or it changed. please implement adjusting it")
 	case protocol.StatusGaveup:
 		if self.IsWorker() {
 			return nil
 		}
+		self.reject(msg.Id)
 		log.Debug("peer gave up on the job. please implement how to select someone else for the job")
 	}
 
 	return nil
 }
 
+// reject counts a submitted job as refused by the worker
+func (self *Demo) reject(id protocol.ID) {
+	if self.submits.Have(id) {
+		self.stats.inc(func(s *Stats) { s.Rejected++ })
+	}
+}
+
 func (self *Demo) requestHandlerLocked(msg *protocol.Request, p *protocols.Peer) error {
 
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
 	log.Trace("have request type", "msg", msg, "currentjobs", self.currentJobs, "ourdifficulty", self.maxDifficulty, "peer", p)
-
-	if self.currentJobs >= self.maxJobs || self.results.IsFull() {
-		go p.Send(context.TODO(),
-			&protocol.Status{
-				Id:   msg.Id,
-				Code: protocol.StatusBusy,
-			},
-		)
+	jobsRequestedCounter.Inc(1)
+
+	if self.draining || self.currentJobs >= self.maxJobs || self.results.IsFull() {
+		if self.draining {
+			jobsRejectedDrainingCounter.Inc(1)
+		} else if self.results.IsFull() {
+			jobsRejectedFullCounter.Inc(1)
+		} else {
+			jobsRejectedBusyCounter.Inc(1)
+		}
+		go self.sendStatus(p, msg.Id, protocol.StatusBusy)
 		log.Error("Too busy!")
 		return nil
 	}
 
 	if self.maxDifficulty < msg.Difficulty {
-		go p.Send(
-			context.TODO(),
-			&protocol.Status{
-				Id:   msg.Id,
-				Code: protocol.StatusAreYouKidding,
-			},
-		)
+		go self.sendStatus(p, msg.Id, protocol.StatusAreYouKidding)
+		jobsRejectedDifficultyCounter.Inc(1)
 		return fmt.Errorf("too hard!")
 	}
+	jobsAcceptedCounter.Inc(1)
+	self.stats.inc(func(s *Stats) { s.Accepted++ })
 	self.currentJobs++
+	self.jobs.Add(1)
 
-	go func(msg *protocol.Request) {
-		ctx, cancel := context.WithTimeout(self.ctx, self.maxTimePerJob)
+	go func(msg *protocol.Request, maxTime time.Duration) {
+		ctx, cancel := context.WithTimeout(self.ctx, maxTime)
 		defer cancel()
+		defer self.jobs.Done()
 
 		log.Debug("took job", "id", fmt.Sprintf("%x", msg.Id), "peer", p.ID().TerminalString)
+		start := time.Now()
 		j, err := doJob(ctx, msg.Data, msg.Difficulty)
 
+		self.mu.Lock()
+		self.currentJobs--
+		self.mu.Unlock()
+
 		if err != nil {
-			go p.Send(
-				context.TODO(),
-				&protocol.Status{
-					Id:   msg.Id,
-					Code: protocol.StatusGaveup,
-				},
-			)
+			go self.sendStatus(p, msg.Id, protocol.StatusGaveup)
 			log.Debug("too long!")
+			jobsGaveupCounter.Inc(1)
+			self.stats.inc(func(s *Stats) { s.Gaveup++ })
 			return
 		}
+		observeMining(msg.Difficulty, time.Since(start))
+		jobsCompletedCounter.Inc(1)
+		self.stats.inc(func(s *Stats) { s.Completed++ })
 
 		res := &protocol.Result{
 			Id:    msg.Id,
@@ -323,20 +561,27 @@ func (self *Demo) requestHandlerLocked(msg *protocol.Request, p *protocols.Peer)
 			Hash:  j.Hash,
 		}
 
-		self.results.Put(msg.Id, res)
-		self.mu.Lock()
-		self.currentJobs--
-		self.mu.Unlock()
+		self.results.Put(msg.Id, res, p, msg.Data, msg.Difficulty)
 
-		go p.Send(context.TODO(), res)
+		go self.sendResult(p, res)
 
 		log.Debug("finished job", "id", fmt.Sprintf("%x", msg.Id), "nonce", j.Nonce, "hash", j.Hash)
-	}(msg)
+	}(msg, self.maxTimePerJob)
 
 	return nil
 }
 
+// resultHandlerLocked verifies a result, and notifies the subscribers of it once the lock is released, so a slow subscriber does not hold up the service
 func (self *Demo) resultHandlerLocked(msg *protocol.Result, p *protocols.Peer) error {
+	res, err := self.acceptResult(msg, p)
+	if res != nil {
+		self.resultFeed.Send(res)
+	}
+	return err
+}
+
+// acceptResult records the result of a job we submitted, and returns it if it is new and verifies
+func (self *Demo) acceptResult(msg *protocol.Result, p *protocols.Peer) (*JobResult, error) {
 	self.mu.RLock()
 	defer self.mu.RUnlock()
 	if self.maxDifficulty > 0 {
@@ -346,20 +591,103 @@ func (self *Demo) resultHandlerLocked(msg *protocol.Result, p *protocols.Peer) e
 
 	if !self.submits.Have(msg.Id) {
 		log.Debug("stale or fake request id", "id", fmt.Sprintf("%x", msg.Id))
-		return nil // in case it's stale not fake don't punish the peer
+		return nil, nil // in case it's stale not fake don't punish the peer
 	}
 	if !checkJob(msg.Hash, self.submits.GetData(msg.Id), msg.Nonce) {
-		return fmt.Errorf("Got incorrect result job %x from %s", msg.Id, p.ID())
+		resultsInvalidCounter.Inc(1)
+		self.stats.inc(func(s *Stats) { s.Invalid++ })
+		return nil, fmt.Errorf("Got incorrect result job %x from %s", msg.Id, p.ID())
+	}
+	go self.sendStatus(p, msg.Id, protocol.StatusThanksABunch)
+
+	// the worker may deliver the same result more than once, for example when it drains before shutdown
+	if res, _ := self.submits.GetResult(msg.Id); res != nil {
+		log.Trace("duplicate result", "id", fmt.Sprintf("%x", msg.Id))
+		return nil, nil
+	}
+	res := &JobResult{
+		Id:     msg.Id,
+		Nonce:  msg.Nonce,
+		Hash:   msg.Hash,
+		Worker: p.ID(),
+	}
+	self.submits.SetResult(msg.Id, res)
+	resultsVerifiedCounter.Inc(1)
+	self.stats.inc(func(s *Stats) { s.Verified++ })
+	if self.save != nil {
+		self.save(self.id, msg.Id, self.submits.GetDifficulty(msg.Id), self.submits.GetData(msg.Id), msg.Nonce, msg.Hash)
+	}
+	return res, nil
+}
+
+// send delivers a message to a peer
+//
+// The send is bound to the service context, and fails if it doesn't complete within the send timeout.
+// A peer that doesn't take the message in time is dropped, which ends the blocked write
+func (self *Demo) send(p *protocols.Peer, msg interface{}) error {
+	ctx, cancel := context.WithTimeout(self.ctx, self.sendTimeout)
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- p.Send(ctx, msg)
+	}()
+	var err error
+	select {
+	case err = <-errC:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			p.Drop(fmt.Errorf("send timeout"))
+		}
+	}
+	if err != nil {
+		sendFailCounter.Inc(1)
+		log.Debug("send fail", "peer", p.ID().TerminalString(), "msg", fmt.Sprintf("%T", msg), "err", err)
+	}
+	return err
+}
+
+func (self *Demo) sendStatus(p *protocols.Peer, id protocol.ID, code uint8) error {
+	return self.send(p, &protocol.Status{
+		Id:   id,
+		Code: code,
+	})
+}
+
+// sendResult delivers a result to the peer that requested the job
+//
+// If the send fails, the result is marked for redelivery. Nothing is sent if the result was acknowledged, or a send of it is still in progress
+func (self *Demo) sendResult(p *protocols.Peer, res *protocol.Result) error {
+	if !self.results.SetSending(res.Id) {
+		return nil
+	}
+	err := self.send(p, res)
+	if err != nil {
+		resultsUndeliveredCounter.Inc(1)
+	}
+	self.results.SetDelivered(res.Id, err == nil)
+	return err
+}
+
+// redeliver periodically retries delivery of results whose last send failed
+//
+// Results that are not acknowledged before they expire are passed to the result sink as usual
+func (self *Demo) redeliver() {
+	tick := time.NewTicker(defaultRedeliverDelay)
+	defer tick.Stop()
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for _, e := range self.results.Pending() {
+			if !e.delivered && !e.sending {
+				log.Trace("redelivering result", "id", fmt.Sprintf("%x", e.prid), "peer", e.peer.ID().TerminalString())
+				go self.sendResult(e.peer, e.Result)
+			}
+		}
 	}
-	go p.Send(
-		context.TODO(),
-		&protocol.Status{
-			Id:   msg.Id,
-			Code: protocol.StatusThanksABunch,
-		},
-	)
-	self.save(self.id, msg.Id, self.submits.GetDifficulty(msg.Id), self.submits.GetData(msg.Id), msg.Nonce, msg.Hash)
-	return nil
 }
 
 func newID(data []byte, nonce uint64) (id protocol.ID) {
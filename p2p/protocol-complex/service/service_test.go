@@ -4,14 +4,24 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"fmt"
+	"io"
 	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
-	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/protocols"
+	p2ptest "github.com/ethereum/go-ethereum/p2p/testing"
+	"github.com/ethereum/go-ethereum/rpc"
 
 	"../protocol"
 )
@@ -20,93 +30,574 @@ func init() {
 	log.Root().SetHandler(log.LvlFilterHandler(log.LvlTrace, log.StderrHandler))
 }
 
-type testPeer struct {
-	*protocols.Peer
-	rw p2p.MsgReader
+// a conformance test case runs a series of message exchanges between the demo service and a single test peer
+//
+// every case starts with the Skills handshake, where the service announces its difficulty
+type conformanceTest struct {
+	name       string
+	params     *DemoParams
+	setup      func(t *testing.T, d *Demo, tester *p2ptest.ProtocolTester, peer enode.ID) <-chan error // runs after the handshake, the error is received after the exchanges
+	exchanges  func(peer enode.ID) []p2ptest.Exchange
+	disconnect func(peer enode.ID) string // if set, the peer is expected to be dropped with an error containing this reason
+	check      func(t *testing.T, d *Demo, peer enode.ID)
 }
 
-func newPeer(s *protocols.Spec) *testPeer {
-	var nid [discover.NodeIDBits / 8]byte
-	lrw, rwr := p2p.MsgPipe()
-	p := protocols.NewPeer(
-		p2p.NewPeer(discover.NodeID(nid), "testpeer", []p2p.Cap{}),
-		lrw,
-		s,
-	)
-	return &testPeer{
-		Peer: p,
-		rw:   rwr,
+func TestProtocolConformance(t *testing.T) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newID(data, 1)
+
+	// mining is deterministic, so we know the result in advance
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	j, err := doJob(ctx, data, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []conformanceTest{
+		{
+			name:   "skills",
+			params: newTestParams(8, 1, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					trigger(peer, &protocol.Skills{Difficulty: 4}),
+				}
+			},
+			check: func(t *testing.T, d *Demo, peer enode.ID) {
+				waitFor(t, "peer skills", func() bool {
+					d.mu.RLock()
+					defer d.mu.RUnlock()
+					for p, skills := range d.workers {
+						if p.ID() == peer && skills.Difficulty == 4 {
+							return true
+						}
+					}
+					return false
+				})
+			},
+		},
+		{
+			name:   "accepted",
+			params: newTestParams(8, 1, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 4},
+						&protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash},
+					),
+					trigger(peer, &protocol.Status{Id: id, Code: protocol.StatusThanksABunch}),
+				}
+			},
+			check: func(t *testing.T, d *Demo, peer enode.ID) {
+				waitFor(t, "result acknowledged", func() bool {
+					return d.results.Count() == 0
+				})
+				stats := d.stats.snapshot()
+				if stats.Accepted != 1 || stats.Completed != 1 || stats.Acknowledged != 1 {
+					t.Fatalf("unexpected worker stats %+v", stats)
+				}
+			},
+		},
+		{
+			name:   "busy",
+			params: newTestParams(8, 0, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 4},
+						&protocol.Status{Id: id, Code: protocol.StatusBusy},
+					),
+				}
+			},
+		},
+		{
+			name:   "too hard",
+			params: newTestParams(8, 1, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 9},
+						&protocol.Status{Id: id, Code: protocol.StatusAreYouKidding},
+					),
+				}
+			},
+			disconnect: func(peer enode.ID) string {
+				return "too hard!"
+			},
+		},
+		{
+			name:   "gave up",
+			params: newTestParams(128, 1, time.Millisecond*10),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 128},
+						&protocol.Status{Id: id, Code: protocol.StatusGaveup},
+					),
+				}
+			},
+		},
+		{
+			name:   "verified result",
+			params: newTestParams(0, 0, 0),
+			setup:  submitSetup(data, 4),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					expect(peer, &protocol.Request{Id: id, Data: data, Difficulty: 4}),
+					exchange(peer,
+						&protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash},
+						&protocol.Status{Id: id, Code: protocol.StatusThanksABunch},
+					),
+				}
+			},
+			check: func(t *testing.T, d *Demo, peer enode.ID) {
+				waitFor(t, "result stored", func() bool {
+					res, _ := d.submits.GetResult(id)
+					return res != nil && res.Worker == peer
+				})
+				stats := d.stats.snapshot()
+				if stats.Submitted != 1 || stats.Verified != 1 || stats.Pending != 0 {
+					t.Fatalf("unexpected moocher stats %+v", stats)
+				}
+				records := d.submits.Records()
+				if len(records) != 1 || records[0].Id != id || !records[0].Verify() {
+					t.Fatalf("expected one verifiable record of job %x, got %v", id, records)
+				}
+			},
+		},
+		{
+			name:   "invalid result",
+			params: newTestParams(0, 0, 0),
+			setup:  submitSetup(data, 4),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					expect(peer, &protocol.Request{Id: id, Data: data, Difficulty: 4}),
+					trigger(peer, &protocol.Result{Id: id, Nonce: j.Nonce, Hash: make([]byte, len(j.Hash))}),
+				}
+			},
+			disconnect: func(peer enode.ID) string {
+				return fmt.Sprintf("Got incorrect result job %x from %s", id, peer)
+			},
+		},
+		{
+			// a peer that doesn't take a message in time is dropped, and the result is left for redelivery
+			name:   "send timeout",
+			params: newTestParams(8, 1, time.Second),
+			setup: func(t *testing.T, d *Demo, tester *p2ptest.ProtocolTester, peer enode.ID) <-chan error {
+				d.sendTimeout = time.Millisecond * 100
+				return nil
+			},
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					trigger(peer, &protocol.Request{Id: id, Data: data, Difficulty: 4}),
+				}
+			},
+			disconnect: func(peer enode.ID) string {
+				return p2p.DiscSubprotocolError.Error()
+			},
+			check: func(t *testing.T, d *Demo, peer enode.ID) {
+				waitFor(t, "result undelivered", func() bool {
+					pending := d.results.Pending()
+					return len(pending) == 1 && !pending[0].delivered && !pending[0].sending
+				})
+				waitFor(t, "peer dropped", func() bool {
+					d.mu.RLock()
+					defer d.mu.RUnlock()
+					return len(d.peers) == 0
+				})
+			},
+		},
+		{
+			name:   "redelivery",
+			params: newTestParams(8, 1, time.Second),
+			setup: func(t *testing.T, d *Demo, tester *p2ptest.ProtocolTester, peer enode.ID) <-chan error {
+				d.mu.RLock()
+				var p *protocols.Peer
+				for pp := range d.peers {
+					p = pp
+				}
+				d.mu.RUnlock()
+				d.results.Put(id, &protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash}, p, data, 4)
+				d.results.SetDelivered(id, false)
+				go d.redeliver()
+				return nil
+			},
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					expect(peer, &protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash}),
+					trigger(peer, &protocol.Status{Id: id, Code: protocol.StatusThanksABunch}),
+				}
+			},
+			check: func(t *testing.T, d *Demo, peer enode.ID) {
+				waitFor(t, "result acknowledged", func() bool {
+					return d.results.Count() == 0
+				})
+				if stats := d.stats.snapshot(); stats.Acknowledged != 1 {
+					t.Fatalf("unexpected worker stats %+v", stats)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runConformanceTest(t, &test)
+		})
 	}
 }
 
-func TestRequestHandler(t *testing.T) {
+func runConformanceTest(t *testing.T, test *conformanceTest) {
+	d, err := NewDemo(test.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.cancel()
+
+	tester, peer := newTester(t, d)
+	defer tester.Stop()
+
+	events := make(chan *p2p.PeerEvent, 1000)
+	sub := tester.Server.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+
+	var setupC <-chan error
+	if test.setup != nil {
+		setupC = test.setup(t, d, tester, peer)
+	}
+
+	err = tester.TestExchanges(test.exchanges(peer)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if setupC != nil {
+		select {
+		case err := <-setupC:
+			if err != nil {
+				t.Fatalf("setup: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for setup")
+		}
+	}
+
+	if test.disconnect != nil {
+		waitDropped(t, events, peer, test.disconnect(peer))
+	}
+
+	if test.check != nil {
+		test.check(t, d, peer)
+	}
+}
 
-	// make service and peer
-	s := NewDemoService(8, 3, time.Millisecond*500)
-	p := newPeer(protocol.Spec)
+// a drain test has the service take jobs from a single test peer, then drains and stops it
+//
+// The calls to the result sink and its close are recorded as "sink" and "close", in the order they are made
+type drainTest struct {
+	name      string
+	params    *DemoParams
+	exchanges func(peer enode.ID) []p2ptest.Exchange // before the drain
+	jobs      int                                    // jobs running when the drain starts
+	results   int                                    // results not acknowledged when the drain starts
+	draining  func(peer enode.ID) []p2ptest.Exchange // after the drain, before the stop
+	calls     []string
+	check     func(t *testing.T, d *Demo)
+}
 
-	// generate data for work
+func TestDrain(t *testing.T) {
 	data := make([]byte, 32)
 	_, err := rand.Read(data)
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
+	id := newID(data, 1)
 
-	// inject easy request, should complete well within a second
-	s.requestHandler(&protocol.Request{
-		Data:       data,
-		Difficulty: 2,
-	}, p.Peer)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	j, err := doJob(ctx, data, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// get the response
-	rlpmsg, _ := p.rw.ReadMsg()
-	resultmsg := &protocol.Result{}
-	if err := rlpmsg.Decode(resultmsg); err != nil {
-		t.Fatal(err.Error())
+	tests := []drainTest{
+		{
+			name:   "acknowledged",
+			params: newDrainParams(8, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 4},
+						&protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash},
+					),
+					trigger(peer, &protocol.Status{Id: id, Code: protocol.StatusThanksABunch}),
+				}
+			},
+			// the drain is announced, and new jobs are refused
+			draining: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					expect(peer, &protocol.Skills{}),
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 4},
+						&protocol.Status{Id: id, Code: protocol.StatusBusy},
+					),
+				}
+			},
+			calls: []string{"close"},
+			check: func(t *testing.T, d *Demo) {
+				info := newDemoAdminAPI(d).Info()
+				if !info.Draining || info.Running {
+					t.Fatalf("expected draining node, got %+v", info)
+				}
+			},
+		},
+		{
+			name:   "unacknowledged",
+			params: newDrainParams(8, time.Second),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					exchange(peer,
+						&protocol.Request{Id: id, Data: data, Difficulty: 4},
+						&protocol.Result{Id: id, Nonce: j.Nonce, Hash: j.Hash},
+					),
+				}
+			},
+			results: 1,
+			// the result is passed to the sink when the drain times out, before the sink is closed
+			calls: []string{"sink", "close"},
+			check: func(t *testing.T, d *Demo) {
+				if d.results.Count() != 0 {
+					t.Fatalf("expected empty result store, got %d results", d.results.Count())
+				}
+			},
+		},
+		{
+			name:   "running",
+			params: newDrainParams(128, time.Second*10),
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					trigger(peer, &protocol.Request{Id: id, Data: data, Difficulty: 128}),
+				}
+			},
+			jobs: 1,
+			// the job is cancelled by the stop, and the stop waits for it
+			calls: []string{"close"},
+			check: func(t *testing.T, d *Demo) {
+				d.mu.RLock()
+				jobs := d.currentJobs
+				d.mu.RUnlock()
+				if jobs != 0 {
+					t.Fatalf("expected no jobs running after stop, got %d", jobs)
+				}
+				stats := d.stats.snapshot()
+				if stats.Accepted != 1 || stats.Gaveup != 1 {
+					t.Fatalf("unexpected worker stats %+v", stats)
+				}
+			},
+		},
 	}
 
-	// inject too high difficulty
-	s.requestHandler(&protocol.Request{
-		Data:       data,
-		Difficulty: 9,
-	}, p.Peer)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runDrainTest(t, &test)
+		})
+	}
+}
 
-	// get the response
-	rlpmsg, _ = p.rw.ReadMsg()
-	statusmsg := &protocol.Status{}
-	if err := rlpmsg.Decode(statusmsg); err != nil {
-		t.Fatal(err.Error())
-	} else if statusmsg.Code != protocol.StatusAreYouKidding {
-		t.Fatalf("Expected StatusGaveup (%d), got %d", protocol.StatusAreYouKidding, statusmsg.Code)
+func runDrainTest(t *testing.T, test *drainTest) {
+	var mu sync.Mutex
+	var calls []string
+	test.params.ResultSink = func(obj interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !obj.(*ResultRecord).Verify() {
+			t.Errorf("sink got unverifiable record %v", obj)
+		}
+		calls = append(calls, "sink")
+		return nil
+	}
+	test.params.CloseSink = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, "close")
+		return nil
+	}
+	d, err := NewDemo(test.params)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer d.cancel()
 
-	// change the difficulty so we can time out
-	s.maxDifficulty = 128
+	tester, peer := newTester(t, d)
+	defer tester.Stop()
 
-	// start three jobs (maxjobs)
-	for i := 0; i < 4; i++ {
-		go s.requestHandler(&protocol.Request{
-			Data:       data,
-			Difficulty: 128,
-		}, p.Peer)
+	err = tester.TestExchanges(test.exchanges(peer)...)
+	if err != nil {
+		t.Fatal(err)
 	}
+	waitFor(t, "jobs and results before drain", func() bool {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.currentJobs == test.jobs && d.results.Count() == test.results
+	})
 
-	rlpmsg, _ = p.rw.ReadMsg()
-	if err := rlpmsg.Decode(statusmsg); err != nil {
-		t.Fatal(err.Error())
-	} else if statusmsg.Code != protocol.StatusBusy {
-		t.Fatalf("Expected StatusBusy (%d), got %d", protocol.StatusBusy, statusmsg.Code)
+	d.Drain()
+	if test.draining != nil {
+		err = tester.TestExchanges(test.draining(peer)...)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
+	d.Stop()
 
-	rlpmsg, _ = p.rw.ReadMsg()
-	if err := rlpmsg.Decode(statusmsg); err != nil {
-		t.Fatal(err.Error())
-	} else if statusmsg.Code != protocol.StatusGaveup {
-		t.Fatalf("Expected StatusGaveup (%d), got %d", protocol.StatusGaveup, statusmsg.Code)
+	mu.Lock()
+	if strings.Join(calls, ",") != strings.Join(test.calls, ",") {
+		t.Fatalf("expected sink calls %v, got %v", test.calls, calls)
+	}
+	mu.Unlock()
+	if test.check != nil {
+		test.check(t, d)
+	}
+}
+
+func newDrainParams(maxDifficulty uint8, maxTime time.Duration) *DemoParams {
+	params := newTestParams(maxDifficulty, 1, maxTime)
+	params.DrainTimeout = time.Millisecond * 100
+	return params
+}
+
+// newTester runs the protocol of the service with a single test peer, and passes the skills handshake
+func newTester(t *testing.T, d *Demo) (*p2ptest.ProtocolTester, enode.ID) {
+	prvkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := p2ptest.NewProtocolTester(prvkey, 1, d.protocol.Run)
+	peer := tester.Nodes[0].ID()
+
+	// the service always opens with its skills
+	err = tester.TestExchanges(expect(peer, &protocol.Skills{Difficulty: d.maxDifficulty}))
+	if err != nil {
+		tester.Stop()
+		t.Fatalf("skills handshake: %v", err)
+	}
+	return tester, peer
+}
+
+func newTestParams(maxDifficulty uint8, maxJobs int, maxTime time.Duration) *DemoParams {
+	params := NewDemoParams(nil, nil)
+	params.Id = make([]byte, 32)
+	params.MaxDifficulty = maxDifficulty
+	params.MaxJobs = maxJobs
+	params.MaxTimePerJob = maxTime
+	params.Source = NewQueueSource(0)
+	return params
+}
+
+// submitSetup announces the test peer as a worker, and makes the service send it a request
+//
+// The request is sent asynchronously, so it can be picked up by an expect in the following exchanges. The returned channel gets the error of the submit
+func submitSetup(data []byte, difficulty uint8) func(*testing.T, *Demo, *p2ptest.ProtocolTester, enode.ID) <-chan error {
+	return func(t *testing.T, d *Demo, tester *p2ptest.ProtocolTester, peer enode.ID) <-chan error {
+		err := tester.TestExchanges(trigger(peer, &protocol.Skills{Difficulty: difficulty}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "worker skills", func() bool {
+			d.mu.RLock()
+			defer d.mu.RUnlock()
+			return len(d.workers) > 0
+		})
+		errC := make(chan error, 1)
+		go func() {
+			_, err := d.submitRequest(data, difficulty)
+			errC <- err
+		}()
+		return errC
+	}
+}
+
+// testSpec is the spec the demo service builds, for the codes of the messages
+var testSpec = func() *protocols.Spec {
+	d, err := NewDemo(NewDemoParams(nil, nil))
+	if err != nil {
+		panic(err)
+	}
+	return d.Spec()
+}()
+
+func code(msg interface{}) uint64 {
+	c, ok := testSpec.GetCode(msg)
+	if !ok {
+		panic(fmt.Sprintf("message %T not in spec", msg))
+	}
+	return c
+}
+
+func trigger(peer enode.ID, msg interface{}) p2ptest.Exchange {
+	return p2ptest.Exchange{
+		Triggers: []p2ptest.Trigger{
+			{
+				Code: code(msg),
+				Msg:  msg,
+				Peer: peer,
+			},
+		},
+	}
+}
+
+func expect(peer enode.ID, msg interface{}) p2ptest.Exchange {
+	return p2ptest.Exchange{
+		Expects: []p2ptest.Expect{
+			{
+				Code: code(msg),
+				Msg:  msg,
+				Peer: peer,
+			},
+		},
+	}
+}
+
+func exchange(peer enode.ID, in interface{}, out interface{}) p2ptest.Exchange {
+	return p2ptest.Exchange{
+		Triggers: trigger(peer, in).Triggers,
+		Expects:  expect(peer, out).Expects,
 	}
+}
 
-	_ = statusmsg
+// waitDropped waits until the peer is dropped with an error containing the reason
+//
+// Only the reason is matched, as the text the protocols package wraps handler errors in changes between versions
+func waitDropped(t *testing.T, events chan *p2p.PeerEvent, peer enode.ID, reason string) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != p2p.PeerEventTypeDrop || ev.Peer != peer {
+				continue
+			}
+			if ev.Error == "" || !strings.Contains(ev.Error, reason) {
+				t.Fatalf("expected peer to be dropped for %q, got %q", reason, ev.Error)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timeout waiting for peer to be dropped for %q", reason)
+		}
+	}
+}
 
+func waitFor(t *testing.T, what string, f func() bool) {
+	timeout := time.After(time.Second)
+	for !f() {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", what)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
 }
 
 func TestJob(t *testing.T) {
@@ -142,3 +633,548 @@ func TestJob(t *testing.T) {
 		t.Fatalf("hash mismatch, expected %x, got %x (check data %x)", result, j.Hash, checkData)
 	}
 }
+
+// results the sink fails to take must stay in the store until it takes them
+func TestResultStoreSinkFail(t *testing.T) {
+	var sinkErr error
+	var sunk []*ResultRecord
+	sinkFunc := func(obj interface{}) error {
+		if sinkErr != nil {
+			return sinkErr
+		}
+		sunk = append(sunk, obj.(*ResultRecord))
+		return nil
+	}
+	store := newResultStore(context.Background(), []byte{0x2a}, sinkFunc)
+	store.releaseDelay = 0
+	for i := byte(0); i < 3; i++ {
+		id := protocol.ID{i}
+		store.Put(id, &protocol.Result{Id: id}, nil, []byte{i}, 1)
+	}
+
+	sinkErr = fmt.Errorf("sink down")
+	store.prune()
+	if store.Count() != 3 {
+		t.Fatalf("expected 3 results kept after failed prune, got %d", store.Count())
+	}
+	if kept := store.Flush(); kept != 3 || store.Count() != 3 {
+		t.Fatalf("expected 3 results kept after failed flush, got %d (count %d)", kept, store.Count())
+	}
+
+	sinkErr = nil
+	store.prune()
+	if store.Count() != 0 {
+		t.Fatalf("expected empty store, got %d results", store.Count())
+	}
+	if len(sunk) != 3 {
+		t.Fatalf("expected 3 results in sink, got %d", len(sunk))
+	}
+}
+
+// the sink is called without the lock held, and a result acknowledged meanwhile must not be put back when the sink fails
+func TestResultStoreAckDuringSink(t *testing.T) {
+	var store *resultStore
+	sinkFunc := func(obj interface{}) error {
+		store.Del(obj.(*ResultRecord).Id)
+		return fmt.Errorf("sink down")
+	}
+	store = newResultStore(context.Background(), []byte{0x2a}, sinkFunc)
+	store.releaseDelay = 0
+	for i := byte(0); i < 3; i++ {
+		id := protocol.ID{i}
+		store.Put(id, &protocol.Result{Id: id}, nil, []byte{i}, 1)
+	}
+	store.prune()
+	if store.Count() != 0 {
+		t.Fatalf("expected acknowledged results removed after prune, got %d", store.Count())
+	}
+
+	for i := byte(0); i < 3; i++ {
+		id := protocol.ID{i}
+		store.Put(id, &protocol.Result{Id: id}, nil, []byte{i}, 1)
+	}
+	if kept := store.Flush(); kept != 0 || store.Count() != 0 {
+		t.Fatalf("expected acknowledged results removed after flush, got %d kept (count %d)", kept, store.Count())
+	}
+}
+
+// a job source test takes jobs from a source, and then expects it to end with an error
+type sourceTest struct {
+	name   string
+	source func(t *testing.T) JobSource
+	jobs   int
+	check  func(data []byte, difficulty uint8) error
+	end    error // the error of the next job, which is given a short deadline
+}
+
+func TestJobSource(t *testing.T) {
+	tests := []sourceTest{
+		{
+			name: "random",
+			source: func(t *testing.T) JobSource {
+				return NewRandomSource(16, time.Millisecond*20, 2, 5)
+			},
+			jobs: 3,
+			check: func(data []byte, difficulty uint8) error {
+				if len(data) != 16 || difficulty < 2 || difficulty >= 5 {
+					return fmt.Errorf("unexpected job %x at difficulty %d", data, difficulty)
+				}
+				return nil
+			},
+			end: context.DeadlineExceeded,
+		},
+		{
+			name: "line",
+			source: func(t *testing.T) JobSource {
+				return NewLineSource(strings.NewReader("0\n\n1\n2"), 3)
+			},
+			jobs:  3,
+			check: checkNumbered(3),
+			end:   io.EOF,
+		},
+		{
+			name: "queue",
+			source: func(t *testing.T) JobSource {
+				q := NewQueueSource(3)
+				for i := 0; i < 3; i++ {
+					if err := q.Push([]byte(fmt.Sprintf("%d", i)), 3); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := q.Push([]byte("3"), 3); err == nil {
+					t.Fatal("expected push to full queue to fail")
+				}
+				return q
+			},
+			jobs:  3,
+			check: checkNumbered(3),
+			end:   context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := test.source(t)
+			for i := 0; i < test.jobs; i++ {
+				data, difficulty, err := source.Next(context.Background())
+				if err != nil {
+					t.Fatalf("job %d: %v", i, err)
+				}
+				if err := test.check(data, difficulty); err != nil {
+					t.Fatalf("job %d: %v", i, err)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+			defer cancel()
+			_, _, err := source.Next(ctx)
+			if err != test.end {
+				t.Fatalf("expected %v after %d jobs, got %v", test.end, test.jobs, err)
+			}
+		})
+	}
+}
+
+// checkNumbered expects jobs with the data "0", "1" and so on, in order, all at the difficulty
+func checkNumbered(difficulty uint8) func([]byte, uint8) error {
+	var n int
+	return func(data []byte, d uint8) error {
+		want := fmt.Sprintf("%d", n)
+		n++
+		if string(data) != want || d != difficulty {
+			return fmt.Errorf("expected job %q at difficulty %d, got %q at %d", want, difficulty, data, d)
+		}
+		return nil
+	}
+}
+
+// a closed line source reads no more lines, even if the reader still has some
+func TestLineSourceClose(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	source := NewLineSource(r, 3)
+
+	// the write returns once the line is read, and the reader then waits to pass it on
+	if _, err := w.Write([]byte("0\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	// give the reader the time to see the close, so it doesn't race the next job for the line
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if data, _, err := source.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected no job after close, got %q (%v)", data, err)
+	}
+
+	// the reader is gone, so nothing takes the next line
+	writeC := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("1\n"))
+		writeC <- err
+	}()
+	select {
+	case err := <-writeC:
+		t.Fatalf("expected no read after close, write returned %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// jobs are submitted in a batch over rpc, and their results polled and streamed
+func TestResultsAPI(t *testing.T) {
+	d, err := NewDemo(newTestParams(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.cancel()
+	tester, peer := newTester(t, d)
+	defer tester.Stop()
+	err = tester.TestExchanges(trigger(peer, &protocol.Skills{Difficulty: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "worker skills", func() bool {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return len(d.workers) > 0
+	})
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("demo", newDemoAPI(d)); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	resultC := make(chan *JobResult, 1)
+	sub, err := client.Subscribe(context.Background(), "demo", resultC, "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// the requests are sent to the worker before the call returns
+	payloads := [][]byte{[]byte("foo"), []byte("bar")}
+	ids := []protocol.ID{newID(payloads[0], 1), newID(payloads[1], 2)}
+	idsC := make(chan []protocol.ID, 1)
+	errC := make(chan error, 1)
+	go func() {
+		var ids []protocol.ID
+		err := client.Call(&ids, "demo_submitBatch", payloads, 4)
+		idsC <- ids
+		errC <- err
+	}()
+	err = tester.TestExchanges(
+		expect(peer, &protocol.Request{Id: ids[0], Data: payloads[0], Difficulty: 4}),
+		expect(peer, &protocol.Request{Id: ids[1], Data: payloads[1], Difficulty: 4}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-idsC; fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Fatalf("expected ids %x, got %x", ids, got)
+	}
+
+	// the first job is done, the second is still pending
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	j, err := doJob(ctx, payloads[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tester.TestExchanges(exchange(peer,
+		&protocol.Result{Id: ids[0], Nonce: j.Nonce, Hash: j.Hash},
+		&protocol.Status{Id: ids[0], Code: protocol.StatusThanksABunch},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &JobResult{
+		Id:     ids[0],
+		Nonce:  j.Nonce,
+		Hash:   j.Hash,
+		Worker: peer,
+	}
+	select {
+	case res := <-resultC:
+		if !reflect.DeepEqual(res, want) {
+			t.Fatalf("expected result %+v, got %+v", want, res)
+		}
+	case err := <-sub.Err():
+		t.Fatalf("subscription: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for result notification")
+	}
+
+	tests := []struct {
+		name string
+		id   protocol.ID
+		want *JobResult
+		err  bool
+	}{
+		{
+			name: "verified",
+			id:   ids[0],
+			want: want,
+		},
+		{
+			name: "pending",
+			id:   ids[1],
+		},
+		{
+			name: "unknown",
+			id:   protocol.ID{0x2a},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var res *JobResult
+			err := client.Call(&res, "demo_getResult", test.id)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(res, test.want) {
+				t.Fatalf("expected result %+v, got %+v", test.want, res)
+			}
+		})
+	}
+}
+
+// an admin test calls the admin api of a worker connected to a single test peer
+type adminTest struct {
+	name      string
+	exchanges func(peer enode.ID) []p2ptest.Exchange // before the call
+	call      func(api *DemoAdminAPI) error
+	err       bool
+	announce  *protocol.Skills // the skills the change is announced with, if any
+	check     func(t *testing.T, api *DemoAdminAPI, peer enode.ID)
+}
+
+func TestAdminAPI(t *testing.T) {
+	tests := []adminTest{
+		{
+			name: "info",
+			call: func(api *DemoAdminAPI) error { return nil },
+			check: func(t *testing.T, api *DemoAdminAPI, peer enode.ID) {
+				want := &NodeInfo{
+					Worker:        true,
+					Running:       true,
+					MaxDifficulty: 8,
+					MaxJobs:       1,
+					MaxTimePerJob: "1s",
+					Peers:         1,
+				}
+				if info := api.Info(); !reflect.DeepEqual(info, want) {
+					t.Fatalf("expected info %+v, got %+v", want, info)
+				}
+			},
+		},
+		{
+			name: "workers",
+			exchanges: func(peer enode.ID) []p2ptest.Exchange {
+				return []p2ptest.Exchange{
+					trigger(peer, &protocol.Skills{Difficulty: 4, MaxSize: 64}),
+				}
+			},
+			call: func(api *DemoAdminAPI) error { return nil },
+			check: func(t *testing.T, api *DemoAdminAPI, peer enode.ID) {
+				want := []*WorkerInfo{{Id: peer, Difficulty: 4, MaxSize: 64}}
+				waitFor(t, "worker", func() bool {
+					return reflect.DeepEqual(api.Workers(), want)
+				})
+			},
+		},
+		{
+			name: "max jobs",
+			call: func(api *DemoAdminAPI) error { return api.SetMaxJobs(3) },
+			check: checkInfo(func(info *NodeInfo) bool {
+				return info.MaxJobs == 3
+			}),
+		},
+		{
+			name: "negative max jobs",
+			call: func(api *DemoAdminAPI) error { return api.SetMaxJobs(-1) },
+			err:  true,
+		},
+		{
+			name: "max time",
+			call: func(api *DemoAdminAPI) error { return api.SetMaxTimePerJob("1500ms") },
+			check: checkInfo(func(info *NodeInfo) bool {
+				return info.MaxTimePerJob == "1.5s"
+			}),
+		},
+		{
+			name: "zero max time",
+			call: func(api *DemoAdminAPI) error { return api.SetMaxTimePerJob("0s") },
+			err:  true,
+		},
+		{
+			name:     "worker",
+			call:     func(api *DemoAdminAPI) error { return api.SetWorker(5) },
+			announce: &protocol.Skills{Difficulty: 5},
+			check: checkInfo(func(info *NodeInfo) bool {
+				return info.Worker && info.MaxDifficulty == 5
+			}),
+		},
+		{
+			name: "worker without difficulty",
+			call: func(api *DemoAdminAPI) error { return api.SetWorker(0) },
+			err:  true,
+		},
+		{
+			name:     "moocher",
+			call:     func(api *DemoAdminAPI) error { return api.SetMoocher() },
+			announce: &protocol.Skills{},
+			check: checkInfo(func(info *NodeInfo) bool {
+				return !info.Worker && info.MaxDifficulty == 0
+			}),
+		},
+		{
+			name: "pause and resume",
+			call: func(api *DemoAdminAPI) error {
+				api.Pause()
+				if api.Info().Running {
+					return fmt.Errorf("running after pause")
+				}
+				return api.Resume()
+			},
+			check: checkInfo(func(info *NodeInfo) bool {
+				return info.Running
+			}),
+		},
+		{
+			name: "resume draining",
+			call: func(api *DemoAdminAPI) error {
+				api.service.Drain()
+				return api.Resume()
+			},
+			err:      true,
+			announce: &protocol.Skills{},
+			check: checkInfo(func(info *NodeInfo) bool {
+				return info.Draining && !info.Running
+			}),
+		},
+		{
+			name: "invalid faults",
+			call: func(api *DemoAdminAPI) error { return api.SetFaults("soon", 0) },
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runAdminTest(t, &test)
+		})
+	}
+}
+
+func runAdminTest(t *testing.T, test *adminTest) {
+	d, err := NewDemo(newTestParams(8, 1, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.cancel()
+	tester, peer := newTester(t, d)
+	defer tester.Stop()
+	api := newDemoAdminAPI(d)
+
+	if test.exchanges != nil {
+		if err := tester.TestExchanges(test.exchanges(peer)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = test.call(api)
+	if (err != nil) != test.err {
+		t.Fatalf("expected error %v, got %v", test.err, err)
+	}
+	if test.announce != nil {
+		if err := tester.TestExchanges(expect(peer, test.announce)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if test.check != nil {
+		test.check(t, api, peer)
+	}
+}
+
+func checkInfo(f func(info *NodeInfo) bool) func(*testing.T, *DemoAdminAPI, enode.ID) {
+	return func(t *testing.T, api *DemoAdminAPI, peer enode.ID) {
+		if info := api.Info(); !f(info) {
+			t.Fatalf("unexpected info %+v", info)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("demo/test/count", r).Inc(3)
+	metrics.NewRegisteredGauge("demo/test/gauge", r).Update(7)
+	metrics.NewRegisteredTimer("demo/test/timer", r).Update(time.Millisecond)
+	observeMining(200, time.Millisecond*50)
+	observeMining(200, time.Second*3)
+
+	w := httptest.NewRecorder()
+	NewMetricsHandler(r).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{
+			name: "counter",
+			lines: []string{
+				"# TYPE demo_test_count counter",
+				"demo_test_count 3",
+			},
+		},
+		{
+			name: "gauge",
+			lines: []string{
+				"# TYPE demo_test_gauge gauge",
+				"demo_test_gauge 7",
+			},
+		},
+		{
+			name: "timer",
+			lines: []string{
+				"# TYPE demo_test_timer summary",
+				"demo_test_timer_sum 1000000",
+				"demo_test_timer_count 1",
+			},
+		},
+		{
+			name: "mining histogram",
+			lines: []string{
+				"# TYPE demo_mining_seconds histogram",
+				`demo_mining_seconds_bucket{difficulty="200",le="0.01"} 0`,
+				`demo_mining_seconds_bucket{difficulty="200",le="0.1"} 1`,
+				`demo_mining_seconds_bucket{difficulty="200",le="2"} 1`,
+				`demo_mining_seconds_bucket{difficulty="200",le="5"} 2`,
+				`demo_mining_seconds_bucket{difficulty="200",le="+Inf"} 2`,
+				`demo_mining_seconds_sum{difficulty="200"} 3.050000`,
+				`demo_mining_seconds_count{difficulty="200"} 2`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, line := range test.lines {
+				if !strings.Contains(body, line+"\n") {
+					t.Fatalf("expected line %q in\n%s", line, body)
+				}
+			}
+		})
+	}
+}
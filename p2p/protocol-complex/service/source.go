@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSubmitDelay      = time.Second
+	defaultQueueCapacity    = 1000
+	defaultDispatchIdleTime = time.Millisecond * 250
+)
+
+// JobSource provides the data a node in moocher mode submits for hashing
+//
+// Next blocks until a job is available or the context is done.
+// It returns io.EOF when the source is exhausted. A source that is also an io.Closer is closed when the service stops
+type JobSource interface {
+	Next(ctx context.Context) (data []byte, difficulty uint8, err error)
+}
+
+type sourceJob struct {
+	data       []byte
+	difficulty uint8
+}
+
+// randomSource generates random data at random difficulties with a fixed delay between each job
+type randomSource struct {
+	dataSize      int
+	delay         time.Duration
+	minDifficulty uint8
+	maxDifficulty uint8
+}
+
+func NewRandomSource(dataSize int, delay time.Duration, minDifficulty uint8, maxDifficulty uint8) JobSource {
+	if delay == 0 {
+		delay = defaultSubmitDelay
+	}
+	return &randomSource{
+		dataSize:      dataSize,
+		delay:         delay,
+		minDifficulty: minDifficulty,
+		maxDifficulty: maxDifficulty,
+	}
+}
+
+func (self *randomSource) Next(ctx context.Context) ([]byte, uint8, error) {
+	timer := time.NewTimer(self.delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, 0, ctx.Err()
+	case <-timer.C:
+	}
+	data := make([]byte, self.dataSize)
+	_, err := rand.Read(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	difficulty := self.minDifficulty
+	if self.maxDifficulty > self.minDifficulty {
+		difficulty += uint8(rand.Intn(int(self.maxDifficulty - self.minDifficulty)))
+	}
+	return data, difficulty, nil
+}
+
+// lineSource submits every non-empty line read from a reader as a job, all with the same difficulty
+//
+// The reader is consumed in a separate goroutine, so a blocking reader like stdin won't block shutdown.
+// The goroutine ends when the source is closed, or at the next line read after that
+type lineSource struct {
+	difficulty uint8
+	lineC      chan []byte
+	err        error
+	quitC      chan struct{}
+	closeOnce  sync.Once
+}
+
+func NewLineSource(r io.Reader, difficulty uint8) JobSource {
+	self := &lineSource{
+		difficulty: difficulty,
+		lineC:      make(chan []byte),
+		quitC:      make(chan struct{}),
+	}
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			line := make([]byte, len(scanner.Bytes()))
+			copy(line, scanner.Bytes())
+			select {
+			case self.lineC <- line:
+			case <-self.quitC:
+				return
+			}
+		}
+		self.err = scanner.Err()
+		close(self.lineC)
+	}()
+	return self
+}
+
+// Close stops reading lines. It does not close the reader
+func (self *lineSource) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.quitC)
+	})
+	return nil
+}
+
+func (self *lineSource) Next(ctx context.Context) ([]byte, uint8, error) {
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case line, ok := <-self.lineC:
+		if !ok {
+			if self.err != nil {
+				return nil, 0, self.err
+			}
+			return nil, 0, io.EOF
+		}
+		return line, self.difficulty, nil
+	}
+}
+
+// QueueSource is a job source that is fed from outside the service, for example through the demo RPC api
+type QueueSource struct {
+	queue chan *sourceJob
+}
+
+func NewQueueSource(capacity int) *QueueSource {
+	if capacity == 0 {
+		capacity = defaultQueueCapacity
+	}
+	return &QueueSource{
+		queue: make(chan *sourceJob, capacity),
+	}
+}
+
+// Push adds a job to the queue
+//
+// It does not block, and returns an error if the queue is full
+func (self *QueueSource) Push(data []byte, difficulty uint8) error {
+	select {
+	case self.queue <- &sourceJob{data: data, difficulty: difficulty}:
+	default:
+		return fmt.Errorf("queue full")
+	}
+	return nil
+}
+
+func (self *QueueSource) Next(ctx context.Context) ([]byte, uint8, error) {
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case j := <-self.queue:
+		return j.data, j.difficulty, nil
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"sync"
+)
+
+// Stats counts the jobs of a node since it started
+type Stats struct {
+	// moocher side
+	Submitted int `json:"submitted"` // jobs sent to workers
+	Verified  int `json:"verified"`  // results of submitted jobs that were verified
+	Invalid   int `json:"invalid"`   // results of submitted jobs that failed verification
+	Rejected  int `json:"rejected"`  // submitted jobs that workers refused or gave up on
+	Pending   int `json:"pending"`   // submitted jobs with neither a verified result nor a rejection
+
+	// worker side
+	Accepted     int `json:"accepted"`     // jobs taken
+	Completed    int `json:"completed"`    // jobs finished
+	Gaveup       int `json:"gaveup"`       // jobs that ran out of time
+	Acknowledged int `json:"acknowledged"` // results the requester confirmed
+}
+
+// Add adds the counts of another Stats
+func (self *Stats) Add(s *Stats) {
+	self.Submitted += s.Submitted
+	self.Verified += s.Verified
+	self.Invalid += s.Invalid
+	self.Rejected += s.Rejected
+	self.Pending += s.Pending
+	self.Accepted += s.Accepted
+	self.Completed += s.Completed
+	self.Gaveup += s.Gaveup
+	self.Acknowledged += s.Acknowledged
+}
+
+// stats keeps the Stats of a node
+//
+// It has its own lock, so it can be updated from handlers holding either lock of the service
+type stats struct {
+	counts Stats
+	mu     sync.Mutex
+}
+
+func (self *stats) inc(f func(s *Stats)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	f(&self.counts)
+}
+
+func (self *stats) snapshot() *Stats {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	s := self.counts
+	s.Pending = s.Submitted - s.Verified - s.Rejected
+	if s.Pending < 0 {
+		s.Pending = 0
+	}
+	return &s
+}
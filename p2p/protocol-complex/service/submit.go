@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+
 	"../protocol"
 )
 
@@ -11,6 +14,14 @@ const (
 	defaultSubmitsCapacity = 1000
 )
 
+// JobResult is the verified result of a job submitted by this node
+type JobResult struct {
+	Id     protocol.ID   `json:"id"`
+	Nonce  hexutil.Bytes `json:"nonce"`
+	Hash   hexutil.Bytes `json:"hash"`
+	Worker enode.ID      `json:"worker"`
+}
+
 type submitStore struct {
 	serial uint64 // last request id sent from this node
 
@@ -18,6 +29,7 @@ type submitStore struct {
 	entries  []*protocol.Request               // a wrapping array cache of requests used to retrieve the request data on a result response
 	cursor   int                               // the current write position on the wrapping array cache
 	idx      map[protocol.ID]*protocol.Request // index to look up the request cache though a request id
+	results  map[protocol.ID]*JobResult        // verified results of the requests in the cache
 	capacity int                               // size of request cache (wrap threshold)
 
 	mu sync.RWMutex
@@ -27,6 +39,7 @@ func newSubmitStore() *submitStore {
 	return &submitStore{
 		entries:  make([]*protocol.Request, defaultSubmitsCapacity),
 		idx:      make(map[protocol.ID]*protocol.Request),
+		results:  make(map[protocol.ID]*JobResult),
 		capacity: defaultSubmitsCapacity,
 	}
 }
@@ -43,6 +56,7 @@ func (self *submitStore) Put(req *protocol.Request, id protocol.ID) error {
 	self.cursor %= self.capacity
 	if self.entries[self.cursor] != nil {
 		delete(self.idx, self.entries[self.cursor].Id)
+		delete(self.results, self.entries[self.cursor].Id)
 	}
 	self.entries[self.cursor] = req
 	self.idx[id] = req
@@ -78,6 +92,46 @@ func (self *submitStore) GetDifficulty(id protocol.ID) uint8 {
 	return 0
 }
 
+// SetResult records the verified result of a request
+func (self *submitStore) SetResult(id protocol.ID, res *JobResult) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.have(id) {
+		self.results[id] = res
+	}
+}
+
+// GetResult returns the verified result of a request, or nil if it is still pending
+//
+// The boolean is false if the request is not in the cache
+func (self *submitStore) GetResult(id protocol.ID) (*JobResult, bool) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if !self.have(id) {
+		return nil, false
+	}
+	return self.results[id], true
+}
+
+// Records returns the verified results in the cache, with the data and difficulty of their requests
+func (self *submitStore) Records() []*ResultRecord {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	records := make([]*ResultRecord, 0, len(self.results))
+	for id, res := range self.results {
+		req := self.idx[id]
+		records = append(records, &ResultRecord{
+			Id:         id,
+			Data:       req.Data,
+			Nonce:      res.Nonce,
+			Hash:       res.Hash,
+			Difficulty: req.Difficulty,
+			Worker:     res.Worker[:],
+		})
+	}
+	return records
+}
+
 func (self *submitStore) IncSerial() uint64 {
 	self.mu.Lock()
 	defer self.mu.Unlock()
@@ -2,17 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
-	"time"
 
 	"github.com/ethereum/go-ethereum/log"
-	"github.com/ethereum/go-ethereum/node"
-	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/simulations"
 	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
 
@@ -20,204 +20,190 @@ import (
 
 	"./protocol"
 	"./resource"
-	"./service"
+	"./simulation"
 )
 
 const (
-	defaultMaxDifficulty   = 24
-	defaultMinDifficulty   = 8
-	defaultSubmitDelay     = time.Millisecond * 100
-	defaultDataSize        = 32
-	defaultMaxTime         = time.Second * 10
-	defaultSimDuration     = time.Second * 5
-	defaultMaxJobs         = 100
 	defaultResourceApiHost = "http://localhost:8500"
+
+	adapterSim  = "sim"
+	adapterExec = "exec"
+
+	// nodes started by the exec adapter rerun this binary, and get the arguments of the simulation and the log dir from the environment
+	envSimArgs = "PROTOCOL_DEMO_SIM_ARGS"
+	envLogDir  = "PROTOCOL_DEMO_SIM_LOGS"
 )
 
 var (
-	loglevel      = flag.Bool("v", false, "loglevel")
-	useResource   = flag.Bool("r", false, "use resource sink")
-	ensAddr       = flag.String("e", "", "ens name to post resource update")
-	maxDifficulty uint8
-	minDifficulty uint8
-	maxTime       time.Duration
-	maxJobs       int
+	loglevel     = flag.Bool("v", false, "loglevel")
+	scenarioFile = flag.String("s", "scenarios/star.json", "scenario file to run")
+	useResource  = flag.Bool("r", false, "use resource sink")
+	ensAddr      = flag.String("e", "", "topic name of the feed to post results to")
+	httpAddr     = flag.String("http", "", "serve the simulation api on this address, and keep running until interrupted")
+	reportFile   = flag.String("report", "-", "file to write the json report of the run to, - for stdout")
+	adapterName  = flag.String("a", adapterSim, "node adapter, sim (all nodes in this process) or exec (a process per node)")
+	dataDir      = flag.String("d", "", "directory for the node data and logs, must not exist or be empty. If not set, a temporary directory is used, which is removed if the run passes")
 )
 
+var runner *simulation.Runner
+
 func init() {
-	flag.Parse()
+	args := os.Args[1:]
+	if s := os.Getenv(envSimArgs); s != "" {
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			log.Crit("invalid simulation arguments in environment", "err", err)
+		}
+	}
+	flag.CommandLine.Parse(args)
 	if *loglevel {
 		log.PrintOrigins(true)
 		log.Root().SetHandler(log.LvlFilterHandler(log.LvlDebug, log.StreamHandler(colorable.NewColorableStderr(), log.TerminalFormat(true))))
 	}
 
-	maxDifficulty = defaultMaxDifficulty
-	minDifficulty = defaultMinDifficulty
-	maxTime = defaultMaxTime
-	maxJobs = defaultMaxJobs
+	scenario, err := simulation.LoadScenario(*scenarioFile)
+	if err != nil {
+		log.Crit(err.Error())
+	}
+	runner, err = simulation.NewRunner(scenario)
+	if err != nil {
+		log.Crit(err.Error())
+	}
+	runner.Save = saveFunc
+	if *useResource {
+		runner.Sink = resourceSink
+	}
+	runner.LogDir = os.Getenv(envLogDir)
 
-	adapters.RegisterServices(newServices())
+	// in a node process started by the exec adapter, this runs the node and does not return
+	adapters.RegisterServices(runner.Services())
 }
 
 func main() {
-	a := adapters.NewSimAdapter(newServices())
-
-	n := simulations.NewNetwork(a, &simulations.NetworkConfig{
-		ID:             "protocol-demo",
-		DefaultService: "demo",
-	})
-	defer n.Shutdown()
-
-	var nids []enode.ID
-	for i := 0; i < 5; i++ {
-		c := adapters.RandomNodeConfig()
-		nod, err := n.NewNodeWithConfig(c)
+	if !run() {
+		os.Exit(1)
+	}
+}
+
+// run runs the scenario, and tells if it passed
+func run() bool {
+	dir, temp, err := newDataDir()
+	if err != nil {
+		log.Error(err.Error())
+		return false
+	}
+	passed := false
+	defer func() {
+		if temp && passed {
+			os.RemoveAll(dir)
+		} else {
+			log.Info("node data and logs kept", "dir", dir)
+		}
+	}()
+
+	var a adapters.NodeAdapter
+	switch *adapterName {
+	case adapterSim:
+		runner.DataDir = dir
+		a = adapters.NewSimAdapter(runner.Services())
+	case adapterExec:
+		a, err = newExecAdapter(dir)
 		if err != nil {
 			log.Error(err.Error())
-			return
+			return false
 		}
-		nids = append(nids, nod.ID())
+	default:
+		log.Error("unknown adapter", "adapter", *adapterName)
+		return false
 	}
 
-	// TODO: need better assertion for network readiness
-	n.StartAll()
-	for i, nid := range nids {
-		if i == 0 {
-			continue
-		}
-		n.Connect(nids[0], nid)
+	defer runner.Shutdown()
+	if err := runner.Start(a); err != nil {
+		log.Error(err.Error())
+		return false
 	}
 
-	go http.ListenAndServe(":8888", simulations.NewServer(n))
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+	if *httpAddr != "" {
+		go http.ListenAndServe(*httpAddr, simulations.NewServer(runner.Network()))
+	}
 
-	quitC := make(chan struct{})
-	trigger := make(chan enode.ID)
-	events := make(chan *simulations.Event)
-	sub := n.Events().Subscribe(events)
-	// event sink on quit
-	defer func() {
-		sub.Unsubscribe()
-		close(quitC)
-		select {
-		case <-events:
-		default:
-		}
-		return
-	}()
+	report := runner.Run(context.Background())
+	if err := writeReport(report); err != nil {
+		log.Error("report write fail", "err", err)
+		return false
+	}
 
-	action := func(ctx context.Context) error {
-		for i, nid := range nids {
-			if i == 0 {
-				log.Info("appointed worker node", "node", nid.String())
-				go func(nid enode.ID) {
-					trigger <- nid
-				}(nid)
-				continue
-			}
-			client, err := n.GetNode(nid).Client()
-			if err != nil {
-				return err
-			}
-			err = client.Call(nil, "demo_setDifficulty", 0)
-			if err != nil {
-				return err
-			}
-
-			go func(nid enode.ID) {
-				timer := time.NewTimer(defaultSimDuration)
-				for {
-					select {
-					case <-events:
-						continue
-					case <-quitC:
-						return
-					case <-ctx.Done():
-						return
-					case <-timer.C:
-					}
-					log.Debug("stop sending", "node", nid)
-					trigger <- nid
-					return
-				}
-			}(nid)
-		}
-		return nil
+	if *httpAddr != "" {
+		sigC := make(chan os.Signal)
+		signal.Notify(sigC, syscall.SIGINT)
+		<-sigC
 	}
-	check := func(ctx context.Context, nid enode.ID) (bool, error) {
-		select {
-		case <-ctx.Done():
-		default:
-		}
-		log.Warn("ok", "nid", nid)
-		return true, nil
-	}
-
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	sim := simulations.NewSimulation(n)
-	step := sim.Run(ctx, &simulations.Step{
-		Action:  action,
-		Trigger: trigger,
-		Expect: &simulations.Expectation{
-			Nodes: nids,
-			Check: check,
-		},
-	})
-	if step.Error != nil {
-		log.Error(step.Error.Error())
-	}
-	for i, nid := range nids {
-		if i == 0 {
-			continue
-		}
-		log.Debug("stopping node", "nid", nid)
-		n.Stop(nid)
+	passed = report.Passed
+	return passed
+}
 
+// newDataDir creates the directory for the node data and logs, and tells if it is a temporary one
+func newDataDir() (string, bool, error) {
+	if *dataDir == "" {
+		dir, err := ioutil.TempDir("", "protocol-demo-sim-")
+		return dir, true, err
+	}
+	dir, err := filepath.Abs(*dataDir)
+	if err != nil {
+		return "", false, err
 	}
-	sigC := make(chan os.Signal)
-	signal.Notify(sigC, syscall.SIGINT)
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 {
+		return "", false, fmt.Errorf("data dir %s is not empty", dir)
+	}
+	return dir, false, os.MkdirAll(dir, 0755)
+}
 
-	<-sigC
+// newExecAdapter runs every node in its own process, rerunning this binary with the same arguments
+//
+// The nodes keep their data in the nodes directory, and write their logs to the logs directory, one file per node name
+func newExecAdapter(dir string) (adapters.NodeAdapter, error) {
+	logDir := filepath.Join(dir, "logs")
+	nodeDir := filepath.Join(dir, "nodes")
+	for _, d := range []string{logDir, nodeDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	args, err := json.Marshal(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	os.Setenv(envSimArgs, string(args))
+	os.Setenv(envLogDir, logDir)
+	return adapters.NewExecAdapter(nodeDir), nil
+}
 
-	return
+func writeReport(report *simulation.Report) error {
+	if *reportFile == "-" {
+		return report.Write(os.Stdout)
+	}
+	f, err := os.Create(*reportFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.Write(f)
 }
 
-func newServices() adapters.Services {
-	haveWorker := false
-	return adapters.Services{
-		"demo": func(node *adapters.ServiceContext) (node.Service, error) {
-			var resourceEnsName string
-			if *ensAddr != "" {
-				resourceEnsName = *ensAddr
-			} else {
-				resourceEnsName = fmt.Sprintf("%x.mutable.test", node.Config.ID[:])
-			}
-			resourceapi := resource.NewClient(defaultResourceApiHost, resourceEnsName)
-			var sinkFunc service.ResultSinkFunc
-			if *useResource {
-				sinkFunc = resourceapi.ResourceSinkFunc()
-			}
-			params := service.NewDemoParams(sinkFunc, saveFunc)
-			params.MaxJobs = maxJobs
-			params.MaxTimePerJob = maxTime
-			if !haveWorker {
-				params.MaxDifficulty = maxDifficulty
-				haveWorker = true
-			}
-			params.SubmitDelay = defaultSubmitDelay
-			params.SubmitDataSize = defaultDataSize
-			params.MaxSubmitDifficulty = defaultMaxDifficulty
-			params.MinSubmitDifficulty = defaultMinDifficulty
-
-			params.Id = node.Config.ID[:]
-			return service.NewDemo(params)
-		},
+// resourceSink publishes the results of a node in batches to its feed through the swarm gateway
+func resourceSink(ctx *adapters.ServiceContext) (*resource.BatchSink, error) {
+	var resourceTopicName string
+	if *ensAddr != "" {
+		resourceTopicName = *ensAddr
+	} else {
+		resourceTopicName = fmt.Sprintf("%x.mutable.test", ctx.Config.ID[:])
+	}
+	resourceapi, err := resource.NewClient(defaultResourceApiHost, resourceTopicName, ctx.Config.PrivateKey)
+	if err != nil {
+		return nil, err
 	}
+	return resource.NewBatchSink(resourceapi, 0, 0), nil
 }
 
 func saveFunc(nid []byte, id protocol.ID, difficulty uint8, data []byte, nonce []byte, hash []byte) {
-	fmt.Fprintf(os.Stdout, "RESULT >> %x/%x : %x@%d|%x => %x\n", nid[:8], id, data, difficulty, nonce, hash)
+	fmt.Fprintf(os.Stderr, "RESULT >> %x/%x : %x@%d|%x => %x\n", nid[:8], id, data, difficulty, nonce, hash)
 }
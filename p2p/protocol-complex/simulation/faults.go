@@ -0,0 +1,97 @@
+package simulation
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// faultEvents draws the node stops and connection drops of the faults during the duration of the run
+//
+// Every stop is followed by a start, and every disconnect by a connect, after the downtime. A node or connection that is down is not picked again until it is back.
+// The events are not in time order
+func faultEvents(faults *Faults, count int, edges []edge, duration time.Duration, rng *rand.Rand) []*Event {
+	var events []*Event
+	if faults == nil {
+		return events
+	}
+	downtime := time.Duration(faults.Downtime)
+
+	if faults.Churn > 0 {
+		back := make([]time.Duration, count)
+		for t := interval(faults.Churn, rng); t < duration; t += interval(faults.Churn, rng) {
+			i := rng.Intn(count)
+			if back[i] > t {
+				continue
+			}
+			back[i] = t + downtime
+			events = append(events,
+				&Event{At: Duration(t), Action: EventStop, Node: i},
+				&Event{At: Duration(t + downtime), Action: EventStart, Node: i},
+			)
+		}
+	}
+
+	if faults.Drops > 0 && len(edges) > 0 {
+		back := make([]time.Duration, len(edges))
+		for t := interval(faults.Drops, rng); t < duration; t += interval(faults.Drops, rng) {
+			i := rng.Intn(len(edges))
+			if back[i] > t {
+				continue
+			}
+			back[i] = t + downtime
+			events = append(events,
+				&Event{At: Duration(t), Action: EventDisconnect, Node: edges[i][0], Peer: edges[i][1]},
+				&Event{At: Duration(t + downtime), Action: EventConnect, Node: edges[i][0], Peer: edges[i][1]},
+			)
+		}
+	}
+	return events
+}
+
+// interval draws a time between faults, with the mean given
+func interval(mean Duration, rng *rand.Rand) time.Duration {
+	return time.Duration(rng.Int63n(2*int64(mean))) + 1
+}
+
+// injectFaults sets the latency and loss of the scenario on the messages a node sends
+func (self *Runner) injectFaults(i int) {
+	f := self.scenario.Faults
+	if f == nil || (f.Latency == 0 && f.Loss == 0) {
+		return
+	}
+	client, err := self.network.GetNode(self.ids[i]).Client()
+	if err == nil {
+		err = client.Call(nil, "demoadmin_setFaults", time.Duration(f.Latency).String(), f.Loss)
+	}
+	if err != nil {
+		log.Warn("inject faults fail", "node", nodeName(i), "err", err)
+	}
+}
+
+// setDropped marks a connection as dropped by an event, so it is not restored when one of its nodes restarts
+func (self *Runner) setDropped(e *Event, dropped bool) {
+	key := edgeKey(e.Node, e.Peer)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if dropped {
+		self.dropped[key] = true
+	} else {
+		delete(self.dropped, key)
+	}
+}
+
+func (self *Runner) isDropped(e edge) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.dropped[edgeKey(e[0], e[1])]
+}
+
+// edgeKey is the edge between the nodes with the lowest index first, so it is the same either way round
+func edgeKey(a, b int) edge {
+	if a > b {
+		return edge{b, a}
+	}
+	return edge{a, b}
+}
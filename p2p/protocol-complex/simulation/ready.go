@@ -0,0 +1,129 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/network"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+
+	"../bzz"
+	"../service"
+)
+
+// ReadyCheck tells if a node is ready, given an rpc client of the node
+type ReadyCheck func(id enode.ID, client *rpc.Client) (bool, error)
+
+// WaitReady polls the check on the nodes until it passes for all of them
+//
+// A node that passed is not checked again. It fails when a check fails, or when the context is done before all nodes are ready
+func WaitReady(ctx context.Context, net *simulations.Network, what string, ids []enode.ID, check ReadyCheck) error {
+	todo := make(map[enode.ID]bool)
+	for _, id := range ids {
+		todo[id] = true
+	}
+	for {
+		for id := range todo {
+			nod := net.GetNode(id)
+			if nod == nil {
+				return fmt.Errorf("%s: unknown node %s", what, id.TerminalString())
+			}
+			client, err := nod.Client()
+			if err != nil {
+				return fmt.Errorf("%s: node %s: %v", what, id.TerminalString(), err)
+			}
+			ok, err := check(id, client)
+			if err != nil {
+				return fmt.Errorf("%s: node %s: %v", what, id.TerminalString(), err)
+			}
+			if ok {
+				delete(todo, id)
+			}
+		}
+		if len(todo) == 0 {
+			log.Debug("network ready", "check", what, "nodes", len(ids))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %d of %d nodes not ready: %v", what, len(todo), len(ids), ctx.Err())
+		case <-time.After(defaultCheckDelay):
+		}
+	}
+}
+
+// WaitHealthy waits until the kademlia of every node knows and is connected to its nearest neighbours among the nodes
+//
+// The nodes must run the bzz service
+func WaitHealthy(ctx context.Context, net *simulations.Network, minBinSize int, ids ...enode.ID) error {
+	var addrs [][]byte
+	byId := make(map[enode.ID][]byte)
+	for _, id := range ids {
+		client, err := net.GetNode(id).Client()
+		if err != nil {
+			return err
+		}
+		var addr string
+		if err := client.Call(&addr, "pss_baseAddr"); err != nil {
+			return err
+		}
+		byId[id] = common.FromHex(addr)
+		addrs = append(addrs, byId[id])
+	}
+	peerpot := network.NewPeerPotMap(minBinSize, addrs)
+	return WaitReady(ctx, net, "kademlia health", ids, func(id enode.ID, client *rpc.Client) (bool, error) {
+		var health network.Health
+		if err := client.Call(&health, "hive_getHealthInfo", peerpot); err != nil {
+			return false, err
+		}
+		log.Trace("health", "id", id, "addr", common.ToHex(byId[id]), "info", health)
+		return health.KnowNN && health.ConnectNN, nil
+	})
+}
+
+// WaitSkills waits until every node has received the skills of at least the given number of workers
+func WaitSkills(ctx context.Context, net *simulations.Network, workers map[enode.ID]int) error {
+	return WaitReady(ctx, net, "worker skills", keys(workers), func(id enode.ID, client *rpc.Client) (bool, error) {
+		var infos []*service.WorkerInfo
+		if err := client.Call(&infos, "demoadmin_workers"); err != nil {
+			return false, err
+		}
+		var count int
+		for _, info := range infos {
+			if info.Difficulty > 0 {
+				count++
+			}
+		}
+		return count >= workers[id], nil
+	})
+}
+
+// WaitPssPeers waits until the pss protocol on the topic has at least the given number of peers on every node
+func WaitPssPeers(ctx context.Context, net *simulations.Network, topic pss.Topic, peers map[enode.ID]int) error {
+	return WaitReady(ctx, net, "pss peers", keys(peers), func(id enode.ID, client *rpc.Client) (bool, error) {
+		var infos []*bzz.ProtocolInfo
+		if err := client.Call(&infos, "pss_protocols"); err != nil {
+			return false, err
+		}
+		for _, info := range infos {
+			if info.Topic == topic {
+				return info.Peers >= peers[id], nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func keys(m map[enode.ID]int) []enode.ID {
+	ids := make([]enode.ID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
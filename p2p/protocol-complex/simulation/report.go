@@ -0,0 +1,149 @@
+package simulation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+
+	"../service"
+)
+
+// NodeReport is the outcome of a run for one node
+type NodeReport struct {
+	Name            string        `json:"name"`
+	Id              enode.ID      `json:"id"`
+	Role            string        `json:"role"`
+	Up              bool          `json:"up"`              // whether the node was running at the end of the run
+	Stats           service.Stats `json:"stats"`           // over every time the node ran
+	Lost            int           `json:"lost"`            // submitted jobs never resolved, including those pending when the node was stopped
+	Checked         int           `json:"checked"`         // verified results the runner verified again
+	InvalidAccepted int           `json:"invalidAccepted"` // verified results that did not verify again
+}
+
+// Report is the machine readable outcome of a run
+type Report struct {
+	Scenario        string        `json:"scenario"`
+	Seed            int64         `json:"seed"`
+	Passed          bool          `json:"passed"`
+	Failures        []string      `json:"failures"`
+	Totals          service.Stats `json:"totals"`
+	Lost            int           `json:"lost"`
+	InvalidAccepted int           `json:"invalidAccepted"`
+	Nodes           []*NodeReport `json:"nodes"`
+}
+
+// Write writes the report as indented json
+func (self *Report) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(self, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (self *Report) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Error("scenario expectation fail", "reason", msg)
+	self.Failures = append(self.Failures, msg)
+}
+
+// snapshot is the state of a node, collected over rpc
+type snapshot struct {
+	stats   service.Stats
+	records []*service.ResultRecord
+}
+
+// collect gets the job counts and verified results of a running node
+func (self *Runner) collect(i int) (*snapshot, error) {
+	client, err := self.network.GetNode(self.ids[i]).Client()
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{}
+	if err := client.Call(&snap.stats, "demoadmin_stats"); err != nil {
+		return nil, err
+	}
+	if err := client.Call(&snap.records, "demoadmin_results"); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// keep collects the state of a node that is about to stop, as it is gone once the node restarts
+func (self *Runner) keep(i int) {
+	snap, err := self.collect(i)
+	if err != nil {
+		log.Warn("collect fail, the counts of the node so far are lost", "node", nodeName(i), "err", err)
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.snapshots[i] = append(self.snapshots[i], snap)
+}
+
+// report collects the state of the running nodes, and checks the outcome of the run against the expectation of the scenario
+func (self *Runner) report(step *simulations.StepResult) *Report {
+	r := &Report{
+		Scenario: self.scenario.Name,
+		Seed:     self.scenario.Seed,
+		Failures: []string{},
+	}
+	if step.Error == context.DeadlineExceeded {
+		log.Warn("not all jobs resolved within the grace time", "grace", self.scenario.Grace)
+	} else if step.Error != nil {
+		r.fail("simulation step fail: %v", step.Error)
+	}
+
+	for i, id := range self.ids {
+		nr := &NodeReport{
+			Name: nodeName(i),
+			Id:   id,
+			Role: self.groups[i].Role,
+			Up:   self.up(i),
+		}
+		self.mu.Lock()
+		snaps := append([]*snapshot{}, self.snapshots[i]...)
+		self.mu.Unlock()
+		if nr.Up {
+			snap, err := self.collect(i)
+			if err != nil {
+				r.fail("node %s collect fail: %v", nr.Name, err)
+			} else {
+				snaps = append(snaps, snap)
+			}
+		}
+		for _, snap := range snaps {
+			nr.Stats.Add(&snap.stats)
+			nr.Lost += snap.stats.Pending
+			for _, rec := range snap.records {
+				nr.Checked++
+				if !rec.Verify() {
+					nr.InvalidAccepted++
+				}
+			}
+		}
+		r.Totals.Add(&nr.Stats)
+		r.Lost += nr.Lost
+		r.InvalidAccepted += nr.InvalidAccepted
+		r.Nodes = append(r.Nodes, nr)
+	}
+
+	expect := self.scenario.Expect
+	if r.InvalidAccepted > 0 {
+		r.fail("%d results were accepted that do not verify", r.InvalidAccepted)
+	}
+	if expect.MaxLost >= 0 && r.Lost > expect.MaxLost {
+		r.fail("%d submitted jobs were never resolved, at most %d allowed", r.Lost, expect.MaxLost)
+	}
+	if r.Totals.Verified < expect.MinVerified {
+		r.fail("%d results were verified, at least %d needed", r.Totals.Verified, expect.MinVerified)
+	}
+	r.Passed = len(r.Failures) == 0
+	return r
+}
@@ -0,0 +1,534 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	swarmapi "github.com/ethereum/go-ethereum/swarm/api"
+	"github.com/ethereum/go-ethereum/swarm/network"
+
+	"../bzz"
+	"../protocol"
+	"../resource"
+	"../service"
+)
+
+const (
+	serviceDemo = "demo"
+	serviceBzz  = "bzz"
+
+	defaultDiscoveryDelay = time.Second
+	defaultCheckDelay     = time.Millisecond * 250
+)
+
+// demoTopic is the pss topic of the demo protocol
+var demoTopic = bzz.ProtocolTopic(&protocols.Spec{Name: protocol.Name, Version: protocol.Version})
+
+// Runner runs a scenario on a simulation network
+type Runner struct {
+	Sink func(ctx *adapters.ServiceContext) (*resource.BatchSink, error) // creates the result sink of a node, closed when the node stops, optional
+	Save service.SaveFunc                                                // gets the verified results of the moochers, optional
+
+	// DataDir keeps the bzz data of the nodes, in a directory per node name, on adapters that don't give nodes a data dir of their own.
+	// If not set, it is left to the defaults of swarm
+	DataDir string
+
+	// LogDir gets a log file per node name, with the debug logs of the node.
+	// It is only for adapters running each node in its own process, as the file is added to the root logger
+	LogDir string
+
+	scenario  *Scenario
+	groups    []*NodeGroup   // by node index
+	byName    map[string]int // node index by node name
+	edges     []edge
+	events    []*Event      // of the scenario, and those drawn from its faults
+	dropped   map[edge]bool // connections dropped by events, see edgeKey
+	network   *simulations.Network
+	configs   []*adapters.NodeConfig
+	ids       []enode.ID
+	index     map[enode.ID]int
+	snapshots [][]*snapshot // of every node, collected before it was stopped
+	mu        sync.Mutex
+}
+
+// NewRunner prepares a run of the scenario
+func NewRunner(scenario *Scenario) (*Runner, error) {
+	groups := scenario.groups()
+	rng := rand.New(rand.NewSource(scenario.Seed))
+	edges, err := topologyEdges(scenario.Topology, len(groups), scenario.Degree, rng)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]int)
+	for i := range groups {
+		byName[nodeName(i)] = i
+	}
+	events := append([]*Event{}, scenario.Events...)
+	events = append(events, faultEvents(scenario.Faults, len(groups), edges, time.Duration(scenario.Duration), rng)...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+	return &Runner{
+		scenario: scenario,
+		groups:   groups,
+		byName:   byName,
+		edges:    edges,
+		events:   events,
+		dropped:  make(map[edge]bool),
+		index:    make(map[enode.ID]int),
+	}, nil
+}
+
+// Services returns the services of the simulation nodes, for the node adapter
+//
+// "demo" runs the demo protocol on devp2p, "bzz" runs it over pss. The role of a node is looked up by its name
+func (self *Runner) Services() adapters.Services {
+	return adapters.Services{
+		serviceDemo: func(ctx *adapters.ServiceContext) (node.Service, error) {
+			return self.newDemo(ctx)
+		},
+		serviceBzz: func(ctx *adapters.ServiceContext) (node.Service, error) {
+			svc, err := self.newDemo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			bzzCfg := swarmapi.NewConfig()
+			bzzCfg.SyncEnabled = false
+			bzzCfg.HiveParams.Discovery = true
+			if dir := ctx.NodeContext.ResolvePath("bzz"); dir != "" {
+				bzzCfg.Path = dir
+			} else if self.DataDir != "" {
+				bzzCfg.Path = filepath.Join(self.DataDir, ctx.Config.Name)
+			}
+			bzzCfg.Init(ctx.Config.PrivateKey)
+			bzzSvc, err := bzz.NewBzzService(bzzCfg, nil)
+			if err != nil {
+				return nil, err
+			}
+			t, err := bzz.ParseTransport(self.scenario.PssTransport)
+			if err != nil {
+				return nil, err
+			}
+			if err := bzzSvc.RegisterPssProtocol(svc, bzz.NewTransportParams(t)); err != nil {
+				return nil, err
+			}
+			if self.scenario.Discovery {
+				bzzSvc.EnableDiscovery(bzz.AllowAll, defaultDiscoveryDelay)
+			}
+			return bzzSvc, nil
+		},
+	}
+}
+
+func (self *Runner) newDemo(ctx *adapters.ServiceContext) (*service.Demo, error) {
+	i, ok := self.byName[ctx.Config.Name]
+	if !ok {
+		return nil, fmt.Errorf("node %s is not in the scenario", ctx.Config.Name)
+	}
+	g := self.groups[i]
+	if self.LogDir != "" {
+		if err := self.logToFile(ctx.Config.Name); err != nil {
+			return nil, err
+		}
+	}
+	params := service.NewDemoParams(nil, self.Save)
+	if self.Sink != nil {
+		sink, err := self.Sink(ctx)
+		if err != nil {
+			return nil, err
+		}
+		params.ResultSink = sink.SinkFunc()
+		params.CloseSink = sink.Close
+	}
+	params.Id = ctx.Config.ID[:]
+	params.FaultSeed = self.scenario.Seed + int64(i)
+	if g.Role == RoleWorker {
+		params.MaxDifficulty = g.MaxDifficulty
+	}
+	params.MaxJobs = g.MaxJobs
+	params.MaxTimePerJob = time.Duration(g.MaxTimePerJob)
+	params.SubmitDelay = time.Duration(g.SubmitDelay)
+	params.SubmitDataSize = g.SubmitDataSize
+	params.MinSubmitDifficulty = g.MinSubmitDifficulty
+	params.MaxSubmitDifficulty = g.MaxSubmitDifficulty
+	return service.NewDemo(params)
+}
+
+// logToFile adds the log file of the node to the root logger, appending to it when the node restarts
+func (self *Runner) logToFile(name string) error {
+	f, err := os.OpenFile(filepath.Join(self.LogDir, name+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("log file fail: %v", err)
+	}
+	h := log.LvlFilterHandler(log.LvlDebug, log.StreamHandler(f, log.LogfmtFormat()))
+	log.Root().SetHandler(log.MultiHandler(log.Root().GetHandler(), h))
+	return nil
+}
+
+func (self *Runner) serviceName() string {
+	if self.scenario.Transport == TransportPss {
+		return serviceBzz
+	}
+	return serviceDemo
+}
+
+// Network returns the simulation network, once the runner is started
+func (self *Runner) Network() *simulations.Network {
+	return self.network
+}
+
+// Start creates the network on the adapter, and starts and connects the nodes
+//
+// It returns once the network is ready to run the scenario: on pss the kademlia of every node is healthy and the moochers have their pss peers,
+// and every moocher has received the skills of its workers. It fails if that takes longer than the ready time of the scenario
+func (self *Runner) Start(adapter adapters.NodeAdapter) error {
+	self.network = simulations.NewNetwork(adapter, &simulations.NetworkConfig{
+		ID:             "protocol-demo",
+		DefaultService: self.serviceName(),
+	})
+	for i := range self.groups {
+		conf := adapters.RandomNodeConfig()
+		conf.Name = nodeName(i)
+		conf.Services = []string{self.serviceName()}
+		nod, err := self.network.NewNodeWithConfig(conf)
+		if err != nil {
+			return err
+		}
+		self.configs = append(self.configs, conf)
+		self.ids = append(self.ids, nod.ID())
+		self.index[nod.ID()] = i
+	}
+	self.snapshots = make([][]*snapshot, len(self.ids))
+	log.Info("starting scenario", "name", self.scenario.Name, "nodes", len(self.ids), "transport", self.scenario.Transport, "topology", self.scenario.Topology)
+
+	if err := self.network.StartAll(); err != nil {
+		return err
+	}
+	for _, e := range self.edges {
+		if err := self.network.Connect(self.ids[e[0]], self.ids[e[1]]); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(self.scenario.Ready))
+	defer cancel()
+	if self.scenario.Transport == TransportPss {
+		if err := WaitHealthy(ctx, self.network, network.NewKadParams().MinProxBinSize, self.ids...); err != nil {
+			return err
+		}
+	}
+	if self.peered() {
+		for _, p := range self.pssPairs() {
+			if err := self.peerPss(p, false); err != nil {
+				return err
+			}
+		}
+	}
+	workers := self.expectedWorkers()
+	if self.scenario.Transport == TransportPss {
+		if err := WaitPssPeers(ctx, self.network, demoTopic, workers); err != nil {
+			return err
+		}
+	}
+	return WaitSkills(ctx, self.network, workers)
+}
+
+// expectedWorkers returns the number of workers every moocher must know of before the run starts
+//
+// On devp2p these are the workers it is connected to, on pss those it is made peers with.
+// With discovery it is not known which workers a moocher finds first, so one has to do
+func (self *Runner) expectedWorkers() map[enode.ID]int {
+	workers := make(map[enode.ID]int)
+	for i, g := range self.groups {
+		if g.Role != RoleMoocher {
+			continue
+		}
+		var count int
+		switch {
+		case self.scenario.Transport == TransportDevp2p:
+			for _, e := range self.edges {
+				if (e[0] == i && self.groups[e[1]].Role == RoleWorker) || (e[1] == i && self.groups[e[0]].Role == RoleWorker) {
+					count++
+				}
+			}
+		case self.peered():
+			for _, p := range self.pssPairs() {
+				if p[0] == i {
+					count++
+				}
+			}
+		default:
+			count = 1
+		}
+		workers[self.ids[i]] = count
+	}
+	return workers
+}
+
+// Shutdown stops all nodes of the network
+func (self *Runner) Shutdown() {
+	if self.network != nil {
+		self.network.Shutdown()
+	}
+}
+
+// Run runs the scenario on the started network, and reports the outcome
+//
+// The moochers submit jobs for the duration of the scenario, while the events are applied.
+// They are then paused, and the run ends when every node has resolved its jobs, or the grace time has passed
+func (self *Runner) Run(ctx context.Context) *Report {
+	duration := time.Duration(self.scenario.Duration)
+	ctx, cancel := context.WithTimeout(ctx, duration+time.Duration(self.scenario.Grace))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	trigger := make(chan enode.ID)
+	action := func(ctx context.Context) error {
+		for i := range self.ids {
+			if self.up(i) {
+				self.injectFaults(i)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self.applyEvents(ctx)
+		}()
+		go func() {
+			timer := time.NewTimer(duration)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			self.pause()
+			ticker := time.NewTicker(defaultCheckDelay)
+			defer ticker.Stop()
+			for {
+				for _, id := range self.ids {
+					select {
+					case trigger <- id:
+					case <-ctx.Done():
+						return
+					}
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return nil
+	}
+	check := func(ctx context.Context, id enode.ID) (bool, error) {
+		return self.resolved(self.index[id]), nil
+	}
+
+	sim := simulations.NewSimulation(self.network)
+	step := sim.Run(ctx, &simulations.Step{
+		Action:  action,
+		Trigger: trigger,
+		Expect: &simulations.Expectation{
+			Nodes: self.ids,
+			Check: check,
+		},
+	})
+	cancel()
+	wg.Wait()
+	return self.report(step)
+}
+
+// pause stops the running moochers from submitting more jobs
+func (self *Runner) pause() {
+	for i, g := range self.groups {
+		if g.Role != RoleMoocher || !self.up(i) {
+			continue
+		}
+		client, err := self.network.GetNode(self.ids[i]).Client()
+		if err == nil {
+			err = client.Call(nil, "demoadmin_pause")
+		}
+		if err != nil {
+			log.Warn("pause fail", "node", nodeName(i), "err", err)
+		}
+	}
+}
+
+// resolved tells if a node has no more jobs in progress
+//
+// A moocher is done when all its jobs have a result or were rejected, a worker when it has no running jobs and no unacknowledged results.
+// A node that is down is done, and one that can't be reached is not
+func (self *Runner) resolved(i int) bool {
+	if !self.up(i) {
+		return true
+	}
+	client, err := self.network.GetNode(self.ids[i]).Client()
+	if err != nil {
+		return false
+	}
+	if self.groups[i].Role == RoleMoocher {
+		var stats service.Stats
+		if err := client.Call(&stats, "demoadmin_stats"); err != nil {
+			log.Debug("stats fail", "node", nodeName(i), "err", err)
+			return false
+		}
+		return stats.Pending == 0
+	}
+	var info service.NodeInfo
+	if err := client.Call(&info, "demoadmin_info"); err != nil {
+		log.Debug("info fail", "node", nodeName(i), "err", err)
+		return false
+	}
+	return info.CurrentJobs == 0 && info.Results == 0
+}
+
+// applyEvents applies the events of the scenario and its faults at their time after the call
+func (self *Runner) applyEvents(ctx context.Context) {
+	start := time.Now()
+	for _, e := range self.events {
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(e.At))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := self.apply(e); err != nil {
+			log.Error("scenario event fail", "action", e.Action, "node", nodeName(e.Node), "err", err)
+		}
+	}
+}
+
+func (self *Runner) apply(e *Event) error {
+	log.Info("scenario event", "action", e.Action, "node", nodeName(e.Node), "at", time.Duration(e.At))
+	id := self.ids[e.Node]
+	switch e.Action {
+	case EventStop:
+		self.keep(e.Node)
+		return self.network.Stop(id)
+	case EventStart:
+		if err := self.network.Start(id); err != nil {
+			return err
+		}
+		self.injectFaults(e.Node)
+		return self.reconnect(e.Node)
+	case EventDisconnect:
+		self.setDropped(e, true)
+		return self.network.Disconnect(id, self.ids[e.Peer])
+	case EventConnect:
+		self.setDropped(e, false)
+		if !self.up(e.Node) || !self.up(e.Peer) {
+			return nil
+		}
+		return self.network.Connect(id, self.ids[e.Peer])
+	}
+	return fmt.Errorf("unknown action %q", e.Action)
+}
+
+func (self *Runner) up(i int) bool {
+	return self.network.GetNode(self.ids[i]).Up
+}
+
+// reconnect restores the connections and pss peers of a restarted node, to the nodes that are up
+//
+// Connections dropped by an event stay down until the event that restores them
+func (self *Runner) reconnect(i int) error {
+	for _, e := range self.edges {
+		if (e[0] != i && e[1] != i) || !self.up(e[0]) || !self.up(e[1]) || self.isDropped(e) {
+			continue
+		}
+		if err := self.network.Connect(self.ids[e[0]], self.ids[e[1]]); err != nil {
+			log.Warn("reconnect fail", "node", nodeName(i), "err", err)
+		}
+	}
+	if !self.peered() {
+		return nil
+	}
+	for _, p := range self.pssPairs() {
+		if (p[0] != i && p[1] != i) || !self.up(p[0]) || !self.up(p[1]) {
+			continue
+		}
+		// a restarted moocher has no session to replace
+		if err := self.peerPss(p, p[1] == i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peered tells if the runner makes the pss peers, instead of leaving it to discovery
+func (self *Runner) peered() bool {
+	return self.scenario.Transport == TransportPss && !self.scenario.Discovery
+}
+
+// pssPairs returns every moocher and worker pair, by node index
+func (self *Runner) pssPairs() []edge {
+	var pairs []edge
+	for i, g := range self.groups {
+		if g.Role != RoleMoocher {
+			continue
+		}
+		for j, h := range self.groups {
+			if h.Role == RoleWorker {
+				pairs = append(pairs, edge{i, j})
+			}
+		}
+	}
+	return pairs
+}
+
+func (self *Runner) pubKey(i int) string {
+	return common.ToHex(crypto.FromECDSAPub(&self.configs[i].PrivateKey.PublicKey))
+}
+
+// peerPss makes a moocher and worker pair pss peers, with the moocher running the demo protocol on the worker
+//
+// With restart set, the protocol session of the moocher on the worker is replaced.
+// On the raw transport the worker adds the moocher as a peer too, as it drops messages from senders that are not peers
+func (self *Runner) peerPss(p edge, restart bool) error {
+	moocher, err := self.network.GetNode(self.ids[p[0]]).Client()
+	if err != nil {
+		return err
+	}
+	worker, err := self.network.GetNode(self.ids[p[1]]).Client()
+	if err != nil {
+		return err
+	}
+	var moocherAddr, workerAddr string
+	if err := moocher.Call(&moocherAddr, "pss_baseAddr"); err != nil {
+		return err
+	}
+	if err := worker.Call(&workerAddr, "pss_baseAddr"); err != nil {
+		return err
+	}
+	topic := demoTopic
+	if self.scenario.PssTransport == bzz.TransportRaw.String() {
+		if err := worker.Call(nil, "pss_addPeer", topic, self.pubKey(p[0]), moocherAddr); err != nil {
+			return err
+		}
+	} else if err := worker.Call(nil, "pss_setPeerPublicKey", self.pubKey(p[0]), common.ToHex(topic[:]), moocherAddr); err != nil {
+		return err
+	}
+	if restart {
+		if err := moocher.Call(nil, "pss_removePeer", topic, self.pubKey(p[1])); err != nil {
+			return err
+		}
+	}
+	return moocher.Call(nil, "pss_addPeer", topic, self.pubKey(p[1]), workerAddr)
+}
@@ -0,0 +1,291 @@
+package simulation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"../bzz"
+)
+
+const (
+	TransportDevp2p = "devp2p"
+	TransportPss    = "pss"
+
+	TopologyStar     = "star"
+	TopologyRing     = "ring"
+	TopologyRandom   = "random"
+	TopologyKademlia = "kademlia"
+
+	RoleWorker  = "worker"
+	RoleMoocher = "moocher"
+
+	EventStop       = "stop"
+	EventStart      = "start"
+	EventDisconnect = "disconnect"
+	EventConnect    = "connect"
+)
+
+const (
+	defaultDuration            = time.Second * 5
+	defaultGrace               = time.Second * 20
+	defaultReady               = time.Second * 30
+	defaultMinVerified         = 1
+	defaultDegree              = 2
+	defaultDowntime            = time.Second * 2
+	defaultMaxDifficulty       = 24
+	defaultMaxJobs             = 100
+	defaultMaxTimePerJob       = time.Second * 10
+	defaultSubmitDelay         = time.Millisecond * 100
+	defaultSubmitDataSize      = 32
+	defaultMinSubmitDifficulty = 8
+	defaultMaxSubmitDifficulty = 24
+)
+
+// Duration is a time.Duration written as a duration string in scenario files, like "1500ms"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	t, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(t)
+	return nil
+}
+
+// Scenario describes a simulation run: the nodes, how they are connected, and what happens to them during the run
+type Scenario struct {
+	Name         string       `json:"name"`
+	Transport    string       `json:"transport"`    // devp2p or pss
+	PssTransport string       `json:"pssTransport"` // asym, sym or raw, see bzz.Transport
+	Discovery    bool         `json:"discovery"`    // pss nodes discover their protocol peers, instead of being connected explicitly
+	Topology     string       `json:"topology"`     // star, ring, random or kademlia
+	Degree       int          `json:"degree"`       // connections per node in the random topology
+	Seed         int64        `json:"seed"`         // seeds every random choice of the run
+	Ready        Duration     `json:"ready"`        // how long to wait for the network to be ready before the run
+	Duration     Duration     `json:"duration"`     // how long the moochers submit jobs
+	Grace        Duration     `json:"grace"`        // how long to wait after that for the submitted jobs to resolve
+	Nodes        []*NodeGroup `json:"nodes"`
+	Events       []*Event     `json:"events"`
+	Faults       *Faults      `json:"faults"`
+	Expect       *Expectation `json:"expect"`
+}
+
+// Faults are injected into the run at random, drawn from the seed of the scenario
+//
+// Node stops and connection drops happen during the duration of the run, on top of the events of the scenario.
+// Latency and loss apply to the demo protocol messages every node sends, from the start of the run
+type Faults struct {
+	Churn    Duration `json:"churn"`    // mean time between stops of random nodes, none if not set
+	Drops    Duration `json:"drops"`    // mean time between drops of random connections, none if not set
+	Downtime Duration `json:"downtime"` // how long a stopped node or a dropped connection stays down
+	Latency  Duration `json:"latency"`  // every message is delayed by a random time up to this
+	Loss     float64  `json:"loss"`     // share of the messages that is dropped, from 0 to 1
+}
+
+// Expectation is what a run must achieve to pass
+//
+// Besides these, a run fails if a moocher accepted a result that does not verify
+type Expectation struct {
+	MaxLost     int `json:"maxLost"`     // submitted jobs that may stay unresolved, -1 for any number
+	MinVerified int `json:"minVerified"` // verified results needed over all moochers
+}
+
+// NodeGroup is a number of nodes with the same role and capabilities
+//
+// Worker nodes use the Max* fields, moocher nodes the Submit* fields. Fields left out get the defaults
+type NodeGroup struct {
+	Count               int      `json:"count"`
+	Role                string   `json:"role"` // worker or moocher
+	MaxDifficulty       uint8    `json:"maxDifficulty"`
+	MaxJobs             int      `json:"maxJobs"`
+	MaxTimePerJob       Duration `json:"maxTimePerJob"`
+	SubmitDelay         Duration `json:"submitDelay"`
+	SubmitDataSize      int      `json:"submitDataSize"`
+	MinSubmitDifficulty uint8    `json:"minSubmitDifficulty"`
+	MaxSubmitDifficulty uint8    `json:"maxSubmitDifficulty"`
+}
+
+// Event changes a node at a time after the start of the run
+type Event struct {
+	At     Duration `json:"at"`
+	Action string   `json:"action"` // stop, start, disconnect or connect
+	Node   int      `json:"node"`   // index of the node, counting through the node groups in order
+	Peer   int      `json:"peer"`   // index of the other node of the connection, for disconnect and connect
+}
+
+// LoadScenario reads a scenario from a json file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %v", path, err)
+	}
+	if err := s.Init(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Init fills in the defaults, and checks that the scenario can be run
+func (self *Scenario) Init() error {
+	if self.Transport == "" {
+		self.Transport = TransportDevp2p
+	}
+	if self.PssTransport == "" {
+		self.PssTransport = bzz.TransportAsym.String()
+	}
+	if self.Topology == "" {
+		self.Topology = TopologyStar
+	}
+	if self.Degree == 0 {
+		self.Degree = defaultDegree
+	}
+	if self.Ready == 0 {
+		self.Ready = Duration(defaultReady)
+	}
+	if self.Duration == 0 {
+		self.Duration = Duration(defaultDuration)
+	}
+	if self.Grace == 0 {
+		self.Grace = Duration(defaultGrace)
+	}
+	if self.Expect == nil {
+		self.Expect = &Expectation{
+			MinVerified: defaultMinVerified,
+		}
+	}
+
+	switch self.Transport {
+	case TransportDevp2p:
+		if self.Discovery {
+			return fmt.Errorf("discovery needs the pss transport")
+		} else if self.Topology == TopologyKademlia {
+			return fmt.Errorf("kademlia topology needs the pss transport")
+		}
+	case TransportPss:
+		if _, err := bzz.ParseTransport(self.PssTransport); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", self.Transport)
+	}
+	switch self.Topology {
+	case TopologyStar, TopologyRing, TopologyRandom, TopologyKademlia:
+	default:
+		return fmt.Errorf("unknown topology %q", self.Topology)
+	}
+
+	var workers int
+	for i, g := range self.Nodes {
+		if g.Count < 1 {
+			return fmt.Errorf("node group %d has no nodes", i)
+		}
+		switch g.Role {
+		case RoleWorker:
+			workers += g.Count
+		case RoleMoocher:
+		default:
+			return fmt.Errorf("node group %d has unknown role %q", i, g.Role)
+		}
+		g.init()
+	}
+	count := self.NodeCount()
+	if count < 2 {
+		return fmt.Errorf("need at least 2 nodes, have %d", count)
+	} else if workers == 0 {
+		return fmt.Errorf("need at least one worker")
+	}
+
+	for i, e := range self.Events {
+		if e.Node < 0 || e.Node >= count {
+			return fmt.Errorf("event %d on unknown node %d", i, e.Node)
+		}
+		switch e.Action {
+		case EventStop, EventStart:
+		case EventDisconnect, EventConnect:
+			if e.Peer < 0 || e.Peer >= count || e.Peer == e.Node {
+				return fmt.Errorf("event %d on invalid peer %d", i, e.Peer)
+			}
+		default:
+			return fmt.Errorf("event %d has unknown action %q", i, e.Action)
+		}
+	}
+	if f := self.Faults; f != nil {
+		if f.Churn < 0 || f.Drops < 0 || f.Downtime < 0 || f.Latency < 0 {
+			return fmt.Errorf("negative fault time")
+		} else if f.Loss < 0 || f.Loss > 1 {
+			return fmt.Errorf("fault loss %v not between 0 and 1", f.Loss)
+		}
+		if f.Downtime == 0 {
+			f.Downtime = Duration(defaultDowntime)
+		}
+	}
+	sort.SliceStable(self.Events, func(i, j int) bool {
+		return self.Events[i].At < self.Events[j].At
+	})
+	return nil
+}
+
+func (self *NodeGroup) init() {
+	if self.MaxDifficulty == 0 {
+		self.MaxDifficulty = defaultMaxDifficulty
+	}
+	if self.MaxJobs == 0 {
+		self.MaxJobs = defaultMaxJobs
+	}
+	if self.MaxTimePerJob == 0 {
+		self.MaxTimePerJob = Duration(defaultMaxTimePerJob)
+	}
+	if self.SubmitDelay == 0 {
+		self.SubmitDelay = Duration(defaultSubmitDelay)
+	}
+	if self.SubmitDataSize == 0 {
+		self.SubmitDataSize = defaultSubmitDataSize
+	}
+	if self.MinSubmitDifficulty == 0 {
+		self.MinSubmitDifficulty = defaultMinSubmitDifficulty
+	}
+	if self.MaxSubmitDifficulty == 0 {
+		self.MaxSubmitDifficulty = defaultMaxSubmitDifficulty
+	}
+}
+
+// NodeCount returns the number of nodes in all groups
+func (self *Scenario) NodeCount() int {
+	var count int
+	for _, g := range self.Nodes {
+		count += g.Count
+	}
+	return count
+}
+
+// groups returns the group of every node, in node index order
+func (self *Scenario) groups() []*NodeGroup {
+	var groups []*NodeGroup
+	for _, g := range self.Nodes {
+		for i := 0; i < g.Count; i++ {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// nodeName is the name of the node with the index in the simulation network
+func nodeName(i int) string {
+	return fmt.Sprintf("node%02d", i)
+}
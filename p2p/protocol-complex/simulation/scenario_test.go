@@ -0,0 +1,181 @@
+package simulation
+
+import (
+	"encoding/json"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the scenarios that come with the demo must all load
+func TestLoadScenarios(t *testing.T) {
+	files, err := filepath.Glob("../scenarios/*.json")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) == 0 {
+		t.Fatal("no scenarios found")
+	}
+	for _, f := range files {
+		if _, err := LoadScenario(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScenarioInvalid(t *testing.T) {
+	cases := map[string]string{
+		"no worker":          `{"nodes": [{"count": 3, "role": "moocher"}]}`,
+		"one node":           `{"nodes": [{"count": 1, "role": "worker"}]}`,
+		"unknown role":       `{"nodes": [{"count": 1, "role": "worker"}, {"count": 1, "role": "boss"}]}`,
+		"unknown topology":   `{"topology": "mesh", "nodes": [{"count": 2, "role": "worker"}]}`,
+		"devp2p kademlia":    `{"topology": "kademlia", "nodes": [{"count": 2, "role": "worker"}]}`,
+		"devp2p discovery":   `{"discovery": true, "nodes": [{"count": 2, "role": "worker"}]}`,
+		"unknown transport":  `{"transport": "udp", "nodes": [{"count": 2, "role": "worker"}]}`,
+		"event on no node":   `{"nodes": [{"count": 2, "role": "worker"}], "events": [{"at": "1s", "action": "stop", "node": 2}]}`,
+		"unknown event":      `{"nodes": [{"count": 2, "role": "worker"}], "events": [{"at": "1s", "action": "explode", "node": 0}]}`,
+		"pss transport fail": `{"transport": "pss", "pssTransport": "carrier pigeon", "nodes": [{"count": 2, "role": "worker"}]}`,
+		"disconnect self":    `{"nodes": [{"count": 2, "role": "worker"}], "events": [{"at": "1s", "action": "disconnect", "node": 1, "peer": 1}]}`,
+		"loss over 1":        `{"nodes": [{"count": 2, "role": "worker"}], "faults": {"loss": 1.5}}`,
+		"negative churn":     `{"nodes": [{"count": 2, "role": "worker"}], "faults": {"churn": "-1s"}}`,
+	}
+	for name, c := range cases {
+		s := &Scenario{}
+		if err := json.Unmarshal([]byte(c), s); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Init(); err == nil {
+			t.Fatalf("%s: expected scenario to be invalid", name)
+		}
+	}
+}
+
+func TestScenarioDefaults(t *testing.T) {
+	s := &Scenario{}
+	if err := json.Unmarshal([]byte(`{"nodes": [{"count": 1, "role": "worker"}, {"count": 2, "role": "moocher", "submitDelay": "1s"}], "events": [{"at": "2s", "action": "start", "node": 1}, {"at": "1s", "action": "stop", "node": 1}]}`), s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Transport != TransportDevp2p || s.Topology != TopologyStar || s.Duration != Duration(defaultDuration) || s.Ready != Duration(defaultReady) {
+		t.Fatalf("defaults not set: %+v", s)
+	}
+	if time.Duration(s.Nodes[1].SubmitDelay) != time.Second || s.Nodes[0].MaxDifficulty != defaultMaxDifficulty {
+		t.Fatalf("node group defaults wrong: %+v", s.Nodes)
+	}
+	if s.Events[0].Action != EventStop {
+		t.Fatal("events not in time order")
+	}
+	if len(s.groups()) != 3 || s.groups()[2] != s.Nodes[1] {
+		t.Fatal("node groups not expanded in order")
+	}
+}
+
+// connected tells if every node can be reached from node 0
+func connected(count int, edges []edge) bool {
+	links := make(map[int][]int)
+	for _, e := range edges {
+		links[e[0]] = append(links[e[0]], e[1])
+		links[e[1]] = append(links[e[1]], e[0])
+	}
+	seen := map[int]bool{0: true}
+	todo := []int{0}
+	for len(todo) > 0 {
+		i := todo[0]
+		todo = todo[1:]
+		for _, j := range links[i] {
+			if !seen[j] {
+				seen[j] = true
+				todo = append(todo, j)
+			}
+		}
+	}
+	return len(seen) == count
+}
+
+func TestTopology(t *testing.T) {
+	for _, topology := range []string{TopologyStar, TopologyRing, TopologyRandom, TopologyKademlia} {
+		edges, err := topologyEdges(topology, 10, 3, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !connected(10, edges) {
+			t.Fatalf("%s topology not connected: %v", topology, edges)
+		}
+		for _, e := range edges {
+			if e[0] == e[1] {
+				t.Fatalf("%s topology connects node %d to itself", topology, e[0])
+			}
+		}
+		again, err := topologyEdges(topology, 10, 3, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(edges, again) {
+			t.Fatalf("%s topology differs with the same seed", topology)
+		}
+	}
+
+	edges, _ := topologyEdges(TopologyStar, 5, 0, nil)
+	if len(edges) != 4 {
+		t.Fatalf("expected 4 edges in star of 5, got %d", len(edges))
+	}
+	edges, _ = topologyEdges(TopologyRing, 5, 0, nil)
+	if len(edges) != 5 {
+		t.Fatalf("expected 5 edges in ring of 5, got %d", len(edges))
+	}
+}
+
+func TestFaultEvents(t *testing.T) {
+	faults := &Faults{
+		Churn:    Duration(time.Second),
+		Drops:    Duration(time.Millisecond * 500),
+		Downtime: Duration(time.Second * 2),
+	}
+	edges, _ := topologyEdges(TopologyRing, 6, 0, nil)
+	events := faultEvents(faults, 6, edges, time.Second*20, rand.New(rand.NewSource(1)))
+	if len(events) == 0 {
+		t.Fatal("no fault events drawn")
+	}
+	again := faultEvents(faults, 6, edges, time.Second*20, rand.New(rand.NewSource(1)))
+	if !reflect.DeepEqual(events, again) {
+		t.Fatal("fault events differ with the same seed")
+	}
+
+	// every stop and disconnect is undone after the downtime, and nothing is taken down twice at once
+	down := make(map[edge]time.Duration)
+	for _, e := range events {
+		key := edge{e.Node, e.Node}
+		if e.Action == EventDisconnect || e.Action == EventConnect {
+			key = edgeKey(e.Node, e.Peer)
+		}
+		switch e.Action {
+		case EventStop, EventDisconnect:
+			if time.Duration(e.At) >= time.Second*20 {
+				t.Fatalf("%s of %v after the duration", e.Action, key)
+			}
+			if until, ok := down[key]; ok && until > time.Duration(e.At) {
+				t.Fatalf("%s of %v while it is down", e.Action, key)
+			}
+			down[key] = time.Duration(e.At + faults.Downtime)
+		}
+	}
+	var stops, starts int
+	for _, e := range events {
+		switch e.Action {
+		case EventStop, EventDisconnect:
+			stops++
+		case EventStart, EventConnect:
+			starts++
+		}
+	}
+	if stops != starts {
+		t.Fatalf("%d faults, but %d restores", stops, starts)
+	}
+
+	if events := faultEvents(&Faults{Loss: 0.1}, 6, edges, time.Second*20, rand.New(rand.NewSource(1))); len(events) != 0 {
+		t.Fatalf("expected no events without churn or drops, got %d", len(events))
+	}
+}
@@ -0,0 +1,62 @@
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// edge is a connection between two nodes, by index
+type edge [2]int
+
+// topologyEdges returns the connections between count nodes in the topology
+//
+// The random and kademlia topologies draw from the rng, so a seeded rng gives the same network every run.
+// In the kademlia topology every node only connects to one node that came before it, the rest is left to the hive discovery of the nodes
+func topologyEdges(topology string, count int, degree int, rng *rand.Rand) ([]edge, error) {
+	var edges []edge
+	switch topology {
+	case TopologyStar:
+		for i := 1; i < count; i++ {
+			edges = append(edges, edge{0, i})
+		}
+
+	case TopologyRing:
+		for i := 1; i < count; i++ {
+			edges = append(edges, edge{i - 1, i})
+		}
+		if count > 2 {
+			edges = append(edges, edge{count - 1, 0})
+		}
+
+	case TopologyKademlia:
+		for i := 1; i < count; i++ {
+			edges = append(edges, edge{rng.Intn(i), i})
+		}
+
+	case TopologyRandom:
+		// a random tree first, so the network is connected
+		have := make(map[edge]bool)
+		add := func(a, b int) {
+			if a > b {
+				a, b = b, a
+			}
+			if a == b || have[edge{a, b}] {
+				return
+			}
+			have[edge{a, b}] = true
+			edges = append(edges, edge{a, b})
+		}
+		for i := 1; i < count; i++ {
+			add(rng.Intn(i), i)
+		}
+		for i := 0; i < count; i++ {
+			for j := 1; j < degree; j++ {
+				add(i, rng.Intn(count))
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown topology %q", topology)
+	}
+	return edges, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+
+	"../../../p2p/protocol-complex/resource"
+)
+
+var (
+	urlFlag     *string = flag.String("url", "http://localhost:8500", "swarm gateway url")
+	rpcFlag     *string = flag.String("rpc", "http://localhost:8545", "rpc endpoint of a pss demo node with the feed api, that the update chunks are fetched from")
+	topicFlag   *string = flag.String("topic", "", "topic name of the feed")
+	userFlag    *string = flag.String("user", "", "user address (in hex)")
+	fromFlag    *uint64 = flag.Uint64("from", 0, "walk epochs from this unix time (default 0)")
+	toFlag      *uint64 = flag.Uint64("to", 0, "walk epochs until this unix time (default now)")
+	batchFlag   *bool   = flag.Bool("b", false, "updates are addresses of result batches; output the verified demo results in them")
+	timeoutFlag *int    = flag.Int("timeout", 300, "seconds to wait for the walk to finish")
+	verboseFlag *bool   = flag.Bool("v", false, "print debug output")
+
+	fd feed.Feed
+)
+
+func croak(r int, s string) {
+	fmt.Fprintln(os.Stderr, "Error: ", s)
+	if r == 1 {
+		fmt.Print("\nUsage: retriever --user <user> --topic <topic> [options]\n\n")
+		flag.PrintDefaults()
+	}
+	os.Exit(r)
+}
+
+func init() {
+	flag.Parse()
+
+	if *verboseFlag {
+		log.Root().SetHandler(log.CallerFileHandler(log.LvlFilterHandler(log.LvlTrace, log.StreamHandler(os.Stderr, log.TerminalFormat(false)))))
+	}
+
+	userBytes, err := hexutil.Decode(*userFlag)
+	if err != nil || len(userBytes) != common.AddressLength {
+		croak(1, fmt.Sprintf("Invalid user address '%s'", *userFlag))
+	}
+	fd.User = common.BytesToAddress(userBytes)
+	fd.Topic, err = feed.NewTopic(*topicFlag, nil)
+	if err != nil {
+		croak(1, fmt.Sprintf("Invalid topic '%s': %v", *topicFlag, err))
+	}
+}
+
+func main() {
+	client, err := rpc.Dial(*rpcFlag)
+	if err != nil {
+		croak(2, fmt.Sprintf("Rpc dial fail: %v", err))
+	}
+	defer client.Close()
+	r := NewRetriever(*urlFlag, client, fd)
+	r.From = *fromFlag
+	r.To = *toFlag
+	if r.To == 0 {
+		r.To = uint64(time.Now().Unix())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(*timeoutFlag))
+	defer cancel()
+
+	// demo results, one json document per line
+	if *batchFlag {
+		results, err := resource.RetrieveResults(ctx, r)
+		if err != nil {
+			croak(2, fmt.Sprintf("Retrieve fail: %v", err))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, res := range results {
+			enc.Encode(res)
+		}
+		return
+	}
+
+	// raw updates: time, level and data
+	updates, err := r.Updates(ctx)
+	if err != nil {
+		croak(2, fmt.Sprintf("Retrieve fail: %v", err))
+	}
+	for _, u := range updates {
+		fmt.Printf("%d\t%d\t%s\n", u.Epoch.Time, u.Epoch.Level, hexutil.Encode(u.Data))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+
+	"../../../p2p/protocol-complex/resource"
+)
+
+const (
+	// layout of a feed update chunk: header | topic | user | epoch | data | signature
+	headerLength    = 8
+	topicOffset     = headerLength
+	userOffset      = topicOffset + feed.TopicLength
+	epochOffset     = userOffset + common.AddressLength
+	dataOffset      = epochOffset + lookup.EpochLength
+	signatureLength = 65
+)
+
+// Update is a verified update of a feed
+type Update struct {
+	Epoch lookup.Epoch
+	Data  []byte
+}
+
+// Retriever walks the epochs of a feed, and downloads the content the updates point to through a swarm gateway
+//
+// A swarm gateway only serves the content of the latest update of a feed at a time, not the update chunks themselves, so the chunks are fetched raw by their address over the rpc of a pss demo node, with feed_chunk.
+// The node is not trusted: the signature of every update is checked.
+// Only the epochs between From and To are walked
+type Retriever struct {
+	From uint64
+	To   uint64
+
+	url    string
+	rpc    *rpc.Client
+	feed   feed.Feed
+	client *http.Client
+}
+
+// NewRetriever creates a retriever for the feed, fetching update chunks over the node rpc client and content through the gateway at bzzapi
+func NewRetriever(bzzapi string, client *rpc.Client, fd feed.Feed) *Retriever {
+	return &Retriever{
+		url:    strings.TrimRight(bzzapi, "/"),
+		rpc:    client,
+		feed:   fd,
+		client: http.DefaultClient,
+	}
+}
+
+// get fetches a path from the gateway
+//
+// It returns nil if the gateway has nothing at the path
+func (self *Retriever) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, self.url+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := self.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s fail: %s: %s", path, resp.Status, body)
+	}
+	return body, nil
+}
+
+// update returns the update in the epoch, or nil if there is none
+//
+// An update that does not verify is an error
+func (self *Retriever) update(ctx context.Context, epoch lookup.Epoch) (*Update, error) {
+	id := feed.ID{
+		Feed:  self.feed,
+		Epoch: epoch,
+	}
+	addr := id.Addr()
+	var chunk hexutil.Bytes
+	if err := self.rpc.CallContext(ctx, &chunk, "feed_chunk", hexutil.Bytes(addr)); err != nil {
+		return nil, err
+	} else if len(chunk) == 0 {
+		return nil, nil
+	}
+	u, err := self.unpack(chunk)
+	if err != nil {
+		return nil, fmt.Errorf("update %x invalid: %v", addr, err)
+	}
+	if u.Epoch.Base() != epoch.Base() || u.Epoch.Level != epoch.Level {
+		return nil, fmt.Errorf("update %x is in epoch %d/%d, expected %d/%d", addr, u.Epoch.Base(), u.Epoch.Level, epoch.Base(), epoch.Level)
+	}
+	return u, nil
+}
+
+// unpack reads an update chunk, and checks that it is signed by the user of the feed
+func (self *Retriever) unpack(chunk []byte) (*Update, error) {
+	if len(chunk) <= dataOffset+signatureLength {
+		return nil, fmt.Errorf("chunk too short, %d bytes", len(chunk))
+	}
+	var epoch lookup.Epoch
+	if err := epoch.UnmarshalBinary(chunk[epochOffset:dataOffset]); err != nil {
+		return nil, err
+	}
+	var fd feed.Feed
+	copy(fd.Topic[:], chunk[topicOffset:userOffset])
+	copy(fd.User[:], chunk[userOffset:epochOffset])
+	if fd != self.feed {
+		return nil, fmt.Errorf("update of another feed, topic %x user %x", fd.Topic, fd.User)
+	}
+	data := chunk[dataOffset : len(chunk)-signatureLength]
+	signature := chunk[len(chunk)-signatureLength:]
+
+	// rebuild the request, so the signature is checked over the same digest the publisher signed
+	values := url.Values{}
+	fd.AppendValues(values)
+	values.Set("time", fmt.Sprintf("%d", epoch.Time))
+	values.Set("level", fmt.Sprintf("%d", epoch.Level))
+	values.Set("signature", hexutil.Encode(signature))
+	var request feed.Request
+	if err := request.FromValues(values, data); err != nil {
+		return nil, err
+	}
+	if err := request.Verify(); err != nil {
+		return nil, err
+	}
+	return &Update{
+		Epoch: epoch,
+		Data:  data,
+	}, nil
+}
+
+// Updates walks all epochs of the feed, and returns the verified updates, oldest first
+func (self *Retriever) Updates(ctx context.Context) ([]*Update, error) {
+	var updates []*Update
+	var mu sync.Mutex
+	get := func(ctx context.Context, epoch lookup.Epoch) (bool, error) {
+		u, err := self.update(ctx, epoch)
+		if err != nil || u == nil {
+			return false, err
+		}
+		log.Debug("found update", "time", u.Epoch.Time, "level", u.Epoch.Level)
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, u)
+		return true, nil
+	}
+	span := uint64(1) << lookup.HighestLevel
+	for t := self.From &^ (span - 1); t <= self.To; t += span {
+		if _, err := resource.WalkEpoch(ctx, lookup.Epoch{Time: t, Level: lookup.HighestLevel}, self.To, get); err != nil {
+			return nil, err
+		}
+	}
+
+	// a later update is in a later epoch, or in a lower level of the same one
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Epoch.Time != updates[j].Epoch.Time {
+			return updates[i].Epoch.Time < updates[j].Epoch.Time
+		}
+		return updates[i].Epoch.Level > updates[j].Epoch.Level
+	})
+	return updates, nil
+}
+
+// History returns the data of every update, oldest first
+//
+// With Download it makes the retriever a resource.Source
+func (self *Retriever) History(ctx context.Context) ([][]byte, error) {
+	updates, err := self.Updates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history := make([][]byte, len(updates))
+	for i, u := range updates {
+		history[i] = u.Data
+	}
+	return history, nil
+}
+
+// Download returns the raw content at the address
+func (self *Retriever) Download(ctx context.Context, addr []byte) ([]byte, error) {
+	data, err := self.get(ctx, "bzz-raw:/"+hex.EncodeToString(addr))
+	if err != nil {
+		return nil, err
+	} else if data == nil {
+		return nil, fmt.Errorf("content %x not found", addr)
+	}
+	return data, nil
+}
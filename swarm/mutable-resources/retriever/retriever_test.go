@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed"
+	"github.com/ethereum/go-ethereum/swarm/storage/feed/lookup"
+
+	"../../../p2p/protocol-complex/resource"
+	"../../../p2p/protocol-complex/resource/resourcetest"
+	"../../../p2p/protocol-complex/service"
+)
+
+// feedChunkAPI hands out the update chunks of the gateway, as a pss demo node does over rpc
+type feedChunkAPI struct {
+	gw *resourcetest.Gateway
+}
+
+func (self *feedChunkAPI) Chunk(addr hexutil.Bytes) hexutil.Bytes {
+	return self.gw.Chunk(addr)
+}
+
+func newChunkServer(t *testing.T, gw *resourcetest.Gateway) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("feed", &feedChunkAPI{gw: gw}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func newTestFeed(t *testing.T) (feed.Feed, *ecdsa.PrivateKey) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic, err := feed.NewTopic("demo.test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed.Feed{
+		Topic: topic,
+		User:  crypto.PubkeyToAddress(key.PublicKey),
+	}, key
+}
+
+// publishes updates in the epochs a feed publisher would choose, and expects to get them all back in order
+func TestRetrieverUpdates(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+	fd, key := newTestFeed(t)
+
+	start := uint64(1540000000)
+	times := []uint64{start, start + 1, start + 2, start + 3, start + 100, start + 5000, start + 1<<20, start + 1<<25 + 7}
+	epoch := lookup.GetFirstEpoch(times[0])
+	var expected [][]byte
+	for i, now := range times {
+		if i > 0 {
+			epoch = lookup.GetNextEpoch(epoch, now)
+		}
+		data := []byte{byte(i), 0x2a}
+		gw.Publish(t, fd, epoch, data, key)
+		expected = append(expected, data)
+	}
+
+	server := newChunkServer(t, gw)
+	defer server.Stop()
+	r := NewRetriever(srv.URL, rpc.DialInProc(server), fd)
+	r.From = start
+	r.To = times[len(times)-1]
+	updates, err := r.Updates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != len(expected) {
+		t.Fatalf("expected %d updates, got %d", len(expected), len(updates))
+	}
+	for i, u := range updates {
+		if u.Epoch.Time != times[i] {
+			t.Fatalf("update %d time mismatch, expected %d, got %d", i, times[i], u.Epoch.Time)
+		}
+		if !bytes.Equal(u.Data, expected[i]) {
+			t.Fatalf("update %d data mismatch, expected %x, got %x", i, expected[i], u.Data)
+		}
+	}
+}
+
+// an update signed by another key than the one of the feed user must fail the walk
+func TestRetrieverForged(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+	fd, key := newTestFeed(t)
+	otherkey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := uint64(1540000000)
+	first := lookup.GetFirstEpoch(start)
+	gw.Publish(t, fd, first, []byte("foo"), key)
+	gw.Publish(t, fd, lookup.GetNextEpoch(first, start+1), []byte("bar"), otherkey)
+
+	server := newChunkServer(t, gw)
+	defer server.Stop()
+	r := NewRetriever(srv.URL, rpc.DialInProc(server), fd)
+	r.From = start
+	r.To = start + 1
+	if _, err := r.Updates(context.Background()); err == nil {
+		t.Fatal("expected forged update to fail the walk")
+	}
+}
+
+// the updates are addresses of result batches, which decode to the demo results
+func TestRetrieverBatch(t *testing.T) {
+	gw := resourcetest.NewGateway()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+	fd, key := newTestFeed(t)
+
+	var records []*service.ResultRecord
+	for i := byte(0); i < 4; i++ {
+		records = append(records, resourcetest.MineRecord(t, i, 4))
+	}
+
+	start := uint64(1540000000)
+	epoch := lookup.GetFirstEpoch(start)
+	for i := 0; i < len(records); i += 2 {
+		batch, err := json.Marshal(&resource.Batch{
+			Version: 1,
+			Results: records[i : i+2],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			epoch = lookup.GetNextEpoch(epoch, start+uint64(i))
+		}
+		gw.Publish(t, fd, epoch, gw.Upload(batch), key)
+	}
+
+	server := newChunkServer(t, gw)
+	defer server.Stop()
+	r := NewRetriever(srv.URL, rpc.DialInProc(server), fd)
+	r.From = start
+	r.To = start + uint64(len(records))
+	results, err := resource.RetrieveResults(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(records) {
+		t.Fatalf("expected %d results, got %d", len(records), len(results))
+	}
+	for i, res := range results {
+		if res.Id != records[i].Id || !bytes.Equal(res.Hash, records[i].Hash) {
+			t.Fatalf("result %d mismatch, expected %x, got %x", i, records[i].Id, res.Id)
+		}
+	}
+}